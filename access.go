@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Access points to files of addresses and CIDRs, one per line, that may or
+// may not connect. With an allow file only the sources it lists get in;
+// the deny file wins over it. Both are read again by "access reload" and on
+// the reload signal, without touching connections already open.
+type Access struct {
+	AllowFile  string `toml:"allow_file"`
+	DenyFile   string `toml:"deny_file"`
+	TarpitSecs int    `toml:"tarpit_seconds"`
+	TarpitMax  int    `toml:"tarpit_max"`
+}
+
+// prefixSet matches an address against many prefixes with one map lookup
+// per prefix length in use.
+type prefixSet struct {
+	bits []int
+	m    map[netip.Prefix]struct{}
+}
+
+func (s *prefixSet) add(p netip.Prefix) {
+	p = p.Masked()
+	if !slices.Contains(s.bits, p.Bits()) {
+		s.bits = append(s.bits, p.Bits())
+	}
+	s.m[p] = struct{}{}
+}
+
+func (s *prefixSet) contains(ip netip.Addr) bool {
+	for _, b := range s.bits {
+		p, err := ip.Prefix(b)
+		if err != nil {
+			continue
+		}
+		if _, ok := s.m[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *prefixSet) len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.m)
+}
+
+type accessList struct {
+	allow, deny *prefixSet
+}
+
+var accessLists atomic.Pointer[accessList]
+
+// readPrefixes loads a list file; blank lines and text after # are ignored.
+func readPrefixes(path string) (*prefixSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &prefixSet{m: map[netip.Prefix]struct{}{}}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if p, err := netip.ParsePrefix(line); err == nil {
+			s.add(p)
+		} else if a, err := netip.ParseAddr(line); err == nil {
+			a = a.Unmap()
+			s.add(netip.PrefixFrom(a, a.BitLen()))
+		} else {
+			return nil, fmt.Errorf("%s:%d: %q is not an address or CIDR", path, n, line)
+		}
+	}
+	return s, sc.Err()
+}
+
+// load reads both files and swaps them in only if both are good.
+func (a *Access) load() error {
+	l := &accessList{}
+	var err error
+	if a.AllowFile != "" {
+		if l.allow, err = readPrefixes(a.AllowFile); err != nil {
+			return fmt.Errorf("allow_file: %v", err)
+		}
+	}
+	if a.DenyFile != "" {
+		if l.deny, err = readPrefixes(a.DenyFile); err != nil {
+			return fmt.Errorf("deny_file: %v", err)
+		}
+	}
+	accessLists.Store(l)
+	return nil
+}
+
+func (a *Access) reload() {
+	if a.AllowFile == "" && a.DenyFile == "" {
+		log.Printf("access: no allow_file or deny_file configured")
+		return
+	}
+	if err := a.load(); err != nil {
+		log.Printf("access: reload: %v, keeping the previous lists", err)
+		return
+	}
+	l := accessLists.Load()
+	log.Printf("access: reloaded, allow=%d deny=%d", l.allow.len(), l.deny.len())
+}
+
+// refuse ends a TCP connection whose source is not let in: at once, or
+// through the tarpit when tarpit_seconds is set.
+func (a *Access) refuse(c net.Conn) {
+	if a.TarpitSecs <= 0 {
+		c.Close()
+		return
+	}
+	go a.tarpit(c)
+}
+
+// tarpit holds a refused connection open for tarpit_seconds with the
+// smallest receive buffer, reading a byte a second, so that scanners and
+// retry loops pay for every attempt. Past tarpit_max held connections the
+// rest are closed at once.
+func (a *Access) tarpit(c net.Conn) {
+	defer c.Close()
+	if atomic.AddInt64(&tarpitHeld, 1) > int64(a.TarpitMax) {
+		atomic.AddInt64(&tarpitHeld, -1)
+		return
+	}
+	defer atomic.AddInt64(&tarpitHeld, -1)
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetReadBuffer(1)
+	}
+	end := time.Now().Add(time.Duration(a.TarpitSecs) * time.Second)
+	c.SetDeadline(end)
+	b := make([]byte, 1)
+	for time.Until(end) > 0 {
+		if _, err := c.Read(b); err != nil {
+			return
+		}
+		time.Sleep(min(time.Second, time.Until(end)))
+	}
+}
+
+// sourceAllowed applies the access lists, the CrowdSec bans and the
+// listener's country and ASN lists to a new client, counting the refusals.
+func (l *Listener) sourceAllowed(ip netip.Addr) bool {
+	var reason string
+	switch {
+	case !accessAllowed(ip):
+		atomic.AddInt64(&accessDenied, 1)
+		reason = "access"
+	case !crowdsecAllowed(ip):
+		atomic.AddInt64(&crowdsecDenied, 1)
+		reason = "crowdsec"
+	case !l.geoAllowed(ip):
+		atomic.AddInt64(&geoDenied, 1)
+		reason = "geo"
+	case !l.asnAllowed(ip):
+		atomic.AddInt64(&asnDenied, 1)
+		reason = "asn"
+	default:
+		return true
+	}
+	if l.Protocol == "tcp" {
+		l.securityEvent("deny", reason, ip, "")
+	}
+	return false
+}
+
+// accessAllowed reports whether the lists let ip in. Sources without an IP,
+// such as unix socket peers, are not subject to them.
+func accessAllowed(ip netip.Addr) bool {
+	l := accessLists.Load()
+	if l == nil || !ip.IsValid() {
+		return true
+	}
+	ip = ip.Unmap()
+	if l.deny != nil && l.deny.contains(ip) {
+		return false
+	}
+	return l.allow == nil || l.allow.contains(ip)
+}
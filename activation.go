@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first descriptor systemd passes (SD_LISTEN_FDS_START).
+const listenFdsStart = 3
+
+// activated holds the sockets passed by systemd socket activation that no
+// listener has claimed yet.
+var activated []activatedSocket
+
+type activatedSocket struct {
+	name string
+	ln   net.Listener
+	pc   net.PacketConn
+}
+
+// loadActivation picks up the sockets systemd passes in LISTEN_FDS. They
+// are meant for this process only, so the variables are cleared.
+func (cfg *Config) loadActivation() {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	// an upgrade cannot know the pid in advance and passes none
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if pid != os.Getpid() && os.Getenv(upgradeReadyEnv) == "" {
+		return
+	}
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := range n {
+		f := os.NewFile(uintptr(listenFdsStart+i), "")
+		s := activatedSocket{}
+		if i < len(names) && cfg.socketNamed(names[i]) {
+			s.name = names[i]
+		}
+		var err error
+		if s.ln, err = net.FileListener(f); err != nil {
+			s.pc, err = net.FilePacketConn(f)
+		}
+		f.Close()
+		if err != nil {
+			log.Printf("systemd: socket %d: %v", listenFdsStart+i, err)
+			continue
+		}
+		activated = append(activated, s)
+	}
+}
+
+// socketNamed reports whether a passed socket's name is one mcproxy uses, a
+// listener's or the metrics socket's. Sockets under any other name, such as
+// "unknown" or the unit name systemd falls back to without
+// FileDescriptorName=, are matched by address instead.
+func (cfg *Config) socketNamed(name string) bool {
+	if name == metricsSocketName {
+		return true
+	}
+	for i := range cfg.Listeners {
+		if cfg.Listeners[i].Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addr is the local address of the passed socket.
+func (s *activatedSocket) addr() net.Addr {
+	if s.ln != nil {
+		return s.ln.Addr()
+	}
+	return s.pc.LocalAddr()
+}
+
+// claim takes the passed sockets meant for the listener: those whose
+// FileDescriptorName= is the listener's name or, for unnamed ones, those
+// bound to its protocol and address.
+func (l *Listener) claim() (lns []net.Listener, pcs []net.PacketConn) {
+	rest := activated[:0]
+	for _, s := range activated {
+		var ok bool
+		if s.name != "" {
+			ok = s.name == l.Name
+		} else {
+			ok = l.bound(s.addr())
+		}
+		switch {
+		case ok && l.Protocol == "tcp" && s.ln != nil:
+			if ul, isUnix := s.ln.(*net.UnixListener); isUnix && os.Getenv(upgradeReadyEnv) != "" {
+				// a unix socket handed over by upgrade is ours to remove,
+				// one from systemd stays systemd's
+				ul.SetUnlinkOnClose(true)
+			}
+			lns = append(lns, s.ln)
+		case ok && l.Protocol == "udp" && s.pc != nil:
+			pcs = append(pcs, s.pc)
+		default:
+			rest = append(rest, s)
+		}
+	}
+	activated = rest
+	return lns, pcs
+}
+
+// takeActivated claims a passed stream socket by name.
+func takeActivated(name string) net.Listener {
+	for i, s := range activated {
+		if s.name == name && s.ln != nil {
+			activated = append(activated[:i], activated[i+1:]...)
+			return s.ln
+		}
+	}
+	return nil
+}
+
+// bound reports whether a socket's local address is the one the listener
+// would listen on.
+func (l *Listener) bound(a net.Addr) bool {
+	if ua, ok := a.(*net.UnixAddr); ok {
+		return ua.Name == l.unix
+	}
+	host, port, err := net.SplitHostPort(l.Address)
+	if err != nil {
+		return false
+	}
+	ip, p := addrIPPort(a)
+	if strconv.Itoa(p) != port {
+		return false
+	}
+	want := net.ParseIP(host)
+	return host == "" || want != nil && (want.IsUnspecified() && ip.IsUnspecified() || want.Equal(ip))
+}
+
+// closeUnclaimed drops the passed sockets that match no listener.
+func closeUnclaimed() {
+	for _, s := range activated {
+		log.Printf("systemd: socket %s %q matches no listener", s.addr(), s.name)
+		if s.ln != nil {
+			s.ln.Close()
+		} else {
+			s.pc.Close()
+		}
+	}
+	activated = nil
+}
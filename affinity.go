@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Affinity remembers which backend of a pool each client IP was sent to, so
+// the player lands on the same server when reconnecting. With file set the
+// table survives a restart of the proxy.
+type Affinity struct {
+	TTLSeconds int    `toml:"ttl_seconds"`
+	File       string `toml:"file"`
+}
+
+type affinityEntry struct {
+	Backend string    `json:"backend"`
+	Seen    time.Time `json:"seen"`
+}
+
+type affinityTable struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	m     map[string]affinityEntry
+	dirty bool
+}
+
+var affinity = &affinityTable{m: map[string]affinityEntry{}}
+
+func affinityKey(p *Pool, cliAddr net.Addr) string {
+	return p.Name + " " + sourceIP(cliAddr).String()
+}
+
+// lookup returns the remembered backend when it is still a healthy member
+// of the pool and not in skip.
+func (t *affinityTable) lookup(p *Pool, cliAddr net.Addr, servers []PoolServer, skip map[string]bool) string {
+	if t.ttl <= 0 || !sourceIP(cliAddr).IsValid() {
+		return ""
+	}
+	t.mu.Lock()
+	e, ok := t.m[affinityKey(p, cliAddr)]
+	t.mu.Unlock()
+	if !ok || time.Since(e.Seen) > t.ttl || skip[e.Backend] || !backendHealthy(e.Backend) ||
+		!slices.ContainsFunc(servers, func(s PoolServer) bool { return s.Address == e.Backend }) {
+		return ""
+	}
+	return e.Backend
+}
+
+func (t *affinityTable) remember(p *Pool, cliAddr net.Addr, addr string) {
+	if t.ttl <= 0 || !sourceIP(cliAddr).IsValid() {
+		return
+	}
+	t.mu.Lock()
+	t.m[affinityKey(p, cliAddr)] = affinityEntry{Backend: addr, Seen: time.Now()}
+	t.dirty = true
+	t.mu.Unlock()
+}
+
+func (a *Affinity) init() error {
+	if a.TTLSeconds < 0 {
+		return errors.New("negative ttl_seconds")
+	}
+	affinity.ttl = time.Duration(a.TTLSeconds) * time.Second
+	if a.TTLSeconds == 0 {
+		return nil
+	}
+	if a.File != "" {
+		b, err := os.ReadFile(a.File)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(b, &affinity.m); err != nil {
+				return err
+			}
+			affinity.expire()
+			log.Printf("affinity: loaded %d entries from %s", len(affinity.m), a.File)
+		case !os.IsNotExist(err):
+			return err
+		}
+	}
+	go func() {
+		for range time.Tick(10 * time.Second) {
+			affinity.expire()
+			a.save()
+		}
+	}()
+	return nil
+}
+
+func (t *affinityTable) expire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, e := range t.m {
+		if time.Since(e.Seen) > t.ttl {
+			delete(t.m, k)
+			t.dirty = true
+		}
+	}
+}
+
+// save writes the table through a temporary file so that a crash never
+// leaves a truncated one behind.
+func (a *Affinity) save() {
+	if a.File == "" || affinity.ttl <= 0 {
+		return
+	}
+	affinity.mu.Lock()
+	if !affinity.dirty {
+		affinity.mu.Unlock()
+		return
+	}
+	b, err := json.Marshal(affinity.m)
+	affinity.dirty = false
+	affinity.mu.Unlock()
+	if err == nil {
+		tmp := a.File + ".tmp"
+		if err = os.WriteFile(tmp, b, 0o600); err == nil {
+			err = os.Rename(tmp, a.File)
+		}
+	}
+	if err != nil {
+		log.Printf("affinity: save %s: %v", a.File, err)
+	}
+}
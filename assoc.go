@@ -0,0 +1,160 @@
+package main
+
+import (
+	"hash/maphash"
+	"log"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// assocShards splits the UDP association table so that lookups from the
+// read loop and the idle sweep rarely wait on each other.
+const assocShards = 16
+
+// assocTable maps client addresses to their UDP associations. Only the
+// table is locked; relaying a datagram happens outside of it.
+type assocTable struct {
+	seed   maphash.Seed
+	shards [assocShards]struct {
+		mu sync.Mutex
+		m  map[netip.AddrPort]*assoc
+	}
+}
+
+func newAssocTable() *assocTable {
+	t := &assocTable{seed: maphash.MakeSeed()}
+	for i := range t.shards {
+		t.shards[i].m = map[netip.AddrPort]*assoc{}
+	}
+	return t
+}
+
+func (t *assocTable) shard(k netip.AddrPort) int {
+	return int(maphash.Comparable(t.seed, k) % assocShards)
+}
+
+func (t *assocTable) get(k netip.AddrPort) *assoc {
+	s := &t.shards[t.shard(k)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m[k]
+}
+
+func (t *assocTable) put(k netip.AddrPort, a *assoc) {
+	s := &t.shards[t.shard(k)]
+	s.mu.Lock()
+	s.m[k] = a
+	s.mu.Unlock()
+}
+
+// remove deletes k if it still maps to a and reports whether it did, so that
+// an association is dropped once however it ends.
+func (t *assocTable) remove(k netip.AddrPort, a *assoc) bool {
+	s := &t.shards[t.shard(k)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m[k] != a {
+		return false
+	}
+	delete(s.m, k)
+	return true
+}
+
+// sweep removes the associations idle for longer than idle or older than
+// lifetime (when positive), or all of them when idle is negative, and hands
+// each to drop.
+func (t *assocTable) sweep(idle, lifetime time.Duration, drop func(*assoc)) {
+	now := time.Now()
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.Lock()
+		for k, a := range s.m {
+			if idle < 0 || now.After(a.expiry(idle, lifetime)) {
+				delete(s.m, k)
+				drop(a)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// udpTables holds the association table of every running UDP socket, with
+// the name of its listener, for udp list.
+var udpTables sync.Map
+
+// udpAssocInfo describes an association for udp list and /udp.
+type udpAssocInfo struct {
+	Listener    string  `json:"listener"`
+	Client      string  `json:"client"`
+	Local       string  `json:"local"`
+	Backend     string  `json:"backend"`
+	AgeSeconds  float64 `json:"age_seconds"`
+	IdleSeconds float64 `json:"idle_seconds"`
+	Player      bool    `json:"player"`
+	UpPackets   int64   `json:"up_packets"`
+	UpBytes     int64   `json:"up_bytes"`
+	DownPackets int64   `json:"down_packets"`
+	DownBytes   int64   `json:"down_bytes"`
+}
+
+// udpAssocs lists the associations whose client address contains filter.
+func udpAssocs(filter string) []udpAssocInfo {
+	now := time.Now()
+	var list []udpAssocInfo
+	udpTables.Range(func(k, v any) bool {
+		t := k.(*assocTable)
+		for i := range t.shards {
+			s := &t.shards[i]
+			s.mu.Lock()
+			for _, a := range s.m {
+				client := a.cliAddr.String()
+				if !strings.Contains(client, filter) {
+					continue
+				}
+				list = append(list, udpAssocInfo{
+					Listener:    v.(string),
+					Client:      client,
+					Local:       a.backend.LocalAddr().String(),
+					Backend:     a.target,
+					AgeSeconds:  now.Sub(time.Unix(0, a.created)).Seconds(),
+					IdleSeconds: now.Sub(time.Unix(0, a.seen.Load())).Seconds(),
+					Player:      a.session.Load() == sessionPlayer,
+					UpPackets:   a.upPackets.Load(),
+					UpBytes:     a.upBytes.Load(),
+					DownPackets: a.downPackets.Load(),
+					DownBytes:   a.downBytes.Load(),
+				})
+			}
+			s.mu.Unlock()
+		}
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Client < list[j].Client })
+	return list
+}
+
+func udpCommand(args []string) {
+	if len(args) == 0 || args[0] != "list" {
+		log.Printf("usage: udp list [client address filter]")
+		return
+	}
+	var filter string
+	if len(args) > 1 {
+		filter = args[1]
+	}
+	list := udpAssocs(filter)
+	for _, a := range list {
+		player := ""
+		if a.Player {
+			player = " player"
+		}
+		log.Printf("udp: %s %s -> %s -> %s age=%s idle=%s up=%d/%dB down=%d/%dB%s", a.Listener, a.Client, a.Local,
+			a.Backend, time.Duration(a.AgeSeconds*float64(time.Second)).Round(time.Second),
+			time.Duration(a.IdleSeconds*float64(time.Second)).Round(time.Second),
+			a.UpPackets, a.UpBytes, a.DownPackets, a.DownBytes, player)
+	}
+	log.Printf("udp: %d associations", len(list))
+}
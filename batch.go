@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Datagrams moved per system call: recvmmsg on the listener socket, and
+// recvmmsg/sendmmsg between one backend socket and its client. The latter
+// is smaller as every association holds its own buffers.
+const (
+	udpBatch        = 32
+	udpBackendBatch = 8
+)
+
+// batchConn reads and writes several datagrams per system call on Linux;
+// elsewhere x/net falls back to one at a time.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(c net.PacketConn) batchConn {
+	if a, ok := c.LocalAddr().(*net.UDPAddr); ok && a.IP.To4() != nil {
+		return ipv4.NewPacketConn(c)
+	}
+	return ipv6.NewPacketConn(c)
+}
+
+func newMessages(n, size int) []ipv4.Message {
+	ms := make([]ipv4.Message, n)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, size)}
+	}
+	return ms
+}
+
+// writeAll sends the batch, continuing after partial writes; it stops at the
+// first error, as UDP senders drop what they cannot deliver anyway.
+func writeAll(c batchConn, ms []ipv4.Message) {
+	for len(ms) > 0 {
+		n, err := c.WriteBatch(ms, 0)
+		if err != nil || n == 0 {
+			return
+		}
+		ms = ms[n:]
+	}
+}
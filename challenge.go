@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// cookieEpoch is how long a cookie handed out in open connection reply 1
+	// stays valid; the one of the previous epoch is accepted too.
+	cookieEpoch = 30 * time.Second
+
+	// pongTTL bounds how old a cached pong may be when answering a ping.
+	pongTTL = 5 * time.Second
+	// maxPingWaiters caps the pings held while the cached pong refreshes.
+	maxPingWaiters = 64
+)
+
+// raknetGate answers the RakNet offline messages of clients that have no
+// association yet, so that packets with spoofed sources never reach the
+// backend or allocate state. Open connection request 1 gets a reply with a
+// cookie bound to the client address; only a request 2 carrying a valid
+// cookie opens an association. Pings are answered from the backend's last
+// pong.
+type raknetGate struct {
+	cookies *addrCookies
+	guid    [8]byte
+
+	probe  *net.UDPConn
+	target string
+	hdr    []byte
+
+	mu      sync.Mutex
+	pong    []byte
+	pongAt  time.Time
+	probed  time.Time
+	waiting []pingWaiter
+}
+
+type pingWaiter struct {
+	addr *net.UDPAddr
+	time [8]byte
+}
+
+// newRaknetGate dials the socket that fetches the backend's pong.
+func (cfg *Config) newRaknetGate(l *Listener) (*raknetGate, error) {
+	g := &raknetGate{cookies: newAddrCookies()}
+	rand.Read(g.guid[:])
+	g.target = l.udpBackend(nil)
+	c, err := cfg.dialUDP(g.target)
+	if err != nil {
+		return nil, err
+	}
+	g.probe = c
+	if cfg.Backend.SendProxyUDP == "v2" {
+		g.hdr = proxyV2(c.LocalAddr(), c.RemoteAddr(), cfg.Backend.ProxyTLVs)
+	}
+	return g, nil
+}
+
+// addrCookies hands out values bound to a client address that expire after
+// one or two epochs. Only the real owner of the address sees the reply that
+// carries one, so echoing it back proves the source is not spoofed.
+type addrCookies struct {
+	key [32]byte
+}
+
+func newAddrCookies() *addrCookies {
+	c := &addrCookies{}
+	rand.Read(c.key[:])
+	return c
+}
+
+func cookieNow() int64 {
+	return time.Now().Unix() / int64(cookieEpoch/time.Second)
+}
+
+func (c *addrCookies) at(addr netip.AddrPort, epoch int64) uint32 {
+	m := hmac.New(sha256.New, c.key[:])
+	b, _ := addr.MarshalBinary()
+	m.Write(b)
+	m.Write(binary.BigEndian.AppendUint64(nil, uint64(epoch)))
+	return binary.BigEndian.Uint32(m.Sum(nil))
+}
+
+func (c *addrCookies) issue(addr netip.AddrPort) uint32 {
+	return c.at(addr, cookieNow())
+}
+
+func (c *addrCookies) valid(addr netip.AddrPort, v uint32) bool {
+	epoch := cookieNow()
+	return v == c.at(addr, epoch) || v == c.at(addr, epoch-1)
+}
+
+// reply1 answers open connection request 1 with the cookie the client must
+// echo in request 2. The MTU is the size of the padded request plus the
+// IP and UDP headers, as RakNet servers do.
+func (g *raknetGate) reply1(p []byte, addr netip.AddrPort) []byte {
+	mtu := min(len(p)+28, 0xffff)
+	out := make([]byte, 0, 32)
+	out = append(out, raknetOpenConnectionReply1)
+	out = append(out, raknetMagic...)
+	out = append(out, g.guid[:]...)
+	out = append(out, 1)
+	out = binary.BigEndian.AppendUint32(out, g.cookies.issue(addr))
+	return binary.BigEndian.AppendUint16(out, uint16(mtu))
+}
+
+// open checks the cookie of open connection request 2 and returns the
+// request without it, as the backend expects from a server without
+// security.
+func (g *raknetGate) open(p []byte, addr netip.AddrPort) ([]byte, bool) {
+	if len(p) < 22 || p[0] != raknetOpenConnectionRequest2 || !bytes.Equal(p[1:17], raknetMagic) {
+		return nil, false
+	}
+	if !g.cookies.valid(addr, binary.BigEndian.Uint32(p[17:21])) {
+		return nil, false
+	}
+	rest := p[22:]
+	if p[21] != 0 {
+		// the client's challenge, never asked for since no key is advertised
+		if len(rest) < 64 {
+			return nil, false
+		}
+		rest = rest[64:]
+	}
+	out := make([]byte, 0, 17+len(rest))
+	out = append(out, p[:17]...)
+	out = append(out, rest...)
+	return out, raknetOpenRequest(out)
+}
+
+// raknetPing reports whether p is an unconnected ping with the offline
+// message magic.
+func raknetPing(p []byte) bool {
+	return len(p) >= 25 && (p[0] == raknetUnconnectedPing || p[0] == raknetOpenConnectionsPing) &&
+		bytes.Equal(p[9:25], raknetMagic)
+}
+
+// ping answers an unconnected ping from the cached pong, or holds it until
+// the probe brings a fresh one.
+func (g *raknetGate) ping(pc net.PacketConn, p []byte, addr *net.UDPAddr) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pong != nil && time.Since(g.pongAt) < pongTTL {
+		pc.WriteTo(pongFor(g.pong, p[1:9]), addr)
+		return
+	}
+	if len(g.waiting) < maxPingWaiters {
+		w := pingWaiter{addr: addr}
+		copy(w.time[:], p[1:9])
+		g.waiting = append(g.waiting, w)
+	}
+	if time.Since(g.probed) >= time.Second {
+		g.probed = time.Now()
+		g.probe.Write(append(g.hdr[:len(g.hdr):len(g.hdr)], p...))
+	}
+}
+
+// relayPongs caches the pongs coming back on the probe socket and answers
+// the pings waiting for them, until the socket is closed.
+func (cfg *Config) relayPongs(g *raknetGate, pc net.PacketConn, size int) {
+	buf := make([]byte, size)
+	for {
+		n, err := g.probe.Read(buf)
+		if err != nil {
+			return
+		}
+		if n == 0 || buf[0] != raknetUnconnectedPong {
+			continue
+		}
+		p := append([]byte(nil), buf[:n]...)
+		recordPong(g.target, p)
+		if cfg.Bedrock.rewrites() {
+			p = cfg.rewritePong(p)
+		}
+		g.mu.Lock()
+		g.pong, g.pongAt = p, time.Now()
+		for _, w := range g.waiting {
+			pc.WriteTo(pongFor(p, w.time[:]), w.addr)
+		}
+		g.waiting = g.waiting[:0]
+		g.mu.Unlock()
+	}
+}
+
+// pongFor copies a pong with the time of the ping it answers.
+func pongFor(pong, t []byte) []byte {
+	out := append([]byte(nil), pong...)
+	if len(out) >= 9 {
+		copy(out[1:9], t)
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+type CircuitBreaker struct {
+	Failures        int `toml:"failures"`
+	CooldownSeconds int `toml:"cooldown_seconds"`
+}
+
+// circuitOpen reports whether traffic to the backend is paused after
+// repeated failures, or while the attempt let through after the cool-down
+// is still running.
+func (st *backendState) circuitOpen() bool {
+	return time.Now().UnixNano() < st.openUntil.Load()
+}
+
+// circuitAttempt reports whether a connection to addr may be tried. Once
+// the cool-down is over the circuit is half-open: the first caller gets the
+// attempt and holds the circuit open for another cool-down until
+// recordDial closes or reopens it; the others are refused meanwhile.
+func (cfg *Config) circuitAttempt(addr string) bool {
+	v, ok := backendStates.Load(addr)
+	if !ok || cfg.Circuit.Failures <= 0 {
+		return true
+	}
+	st := v.(*backendState)
+	until := st.openUntil.Load()
+	if until == 0 {
+		return true
+	}
+	now := time.Now()
+	if now.UnixNano() < until {
+		return false
+	}
+	cool := time.Duration(cfg.Circuit.CooldownSeconds) * time.Second
+	if !st.openUntil.CompareAndSwap(until, now.Add(cool).UnixNano()) {
+		return false
+	}
+	st.probing.Store(true)
+	return true
+}
+
+// recordDial feeds a dial or handshake outcome into the backend's circuit
+// breaker. A success closes the circuit; a failure opens it once failures
+// are reached, and again right away when the half-open attempt fails.
+// UDP associations are not dialled, so a UDP backend takes traffic again
+// after the cool-down and its first failure reopens the circuit.
+func (cfg *Config) recordDial(addr string, err error) {
+	if cfg.Circuit.Failures <= 0 || err == errBackendDown {
+		return
+	}
+	st := stateOf(addr)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err == nil {
+		if st.openUntil.Swap(0) != 0 {
+			log.Printf("backend %s: circuit closed", addr)
+		}
+		st.probing.Store(false)
+		st.fails = 0
+		return
+	}
+	st.fails++
+	if st.fails < cfg.Circuit.Failures {
+		return
+	}
+	if st.openUntil.Load() == 0 || st.probing.Swap(false) || !st.circuitOpen() {
+		cool := time.Duration(cfg.Circuit.CooldownSeconds) * time.Second
+		st.openUntil.Store(time.Now().Add(cool).UnixNano())
+		log.Printf("backend %s: circuit open for %v after %d failures: %v", addr, cool, st.fails, err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitHalfOpen(t *testing.T) {
+	cfg := &Config{Circuit: CircuitBreaker{Failures: 2, CooldownSeconds: 30}}
+	addr := "circuit.test:25565"
+	fail := errors.New("refused")
+	cfg.recordDial(addr, fail)
+	if !cfg.circuitAttempt(addr) {
+		t.Fatal("refused below the failure count")
+	}
+	cfg.recordDial(addr, fail)
+	if cfg.circuitAttempt(addr) || backendHealthy(addr) {
+		t.Fatal("circuit not open after 2 failures")
+	}
+
+	st := stateOf(addr)
+	st.openUntil.Store(time.Now().Add(-time.Second).UnixNano())
+	if !backendHealthy(addr) {
+		t.Fatal("not healthy after the cool-down")
+	}
+	if !cfg.circuitAttempt(addr) {
+		t.Fatal("half-open attempt refused")
+	}
+	if cfg.circuitAttempt(addr) || backendHealthy(addr) {
+		t.Fatal("second attempt let through while the first runs")
+	}
+	cfg.recordDial(addr, fail)
+	if !st.circuitOpen() || st.probing.Load() {
+		t.Fatal("failed attempt did not reopen the circuit")
+	}
+
+	st.openUntil.Store(time.Now().Add(-time.Second).UnixNano())
+	if !cfg.circuitAttempt(addr) {
+		t.Fatal("half-open attempt refused")
+	}
+	cfg.recordDial(addr, nil)
+	if !cfg.circuitAttempt(addr) || !cfg.circuitAttempt(addr) || !backendHealthy(addr) {
+		t.Fatal("success did not close the circuit")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Consul struct {
+	Address    string `toml:"address"`
+	Token      string `toml:"token"`
+	Datacenter string `toml:"datacenter"`
+}
+
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+var consulClient = &http.Client{Timeout: 6 * time.Minute}
+
+// services lists the passing instances of a service. It is a
+// blocking query: with a non-zero index Consul holds the request until the
+// service changes or the wait expires.
+func (c *Consul) services(name, tag string, index uint64) ([]PoolServer, uint64, error) {
+	q := url.Values{"passing": {"1"}, "index": {strconv.FormatUint(index, 10)}, "wait": {"5m"}}
+	if tag != "" {
+		q.Set("tag", tag)
+	}
+	if c.Datacenter != "" {
+		q.Set("dc", c.Datacenter)
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(c.Address, "/")+"/v1/health/service/"+url.PathEscape(name)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, index, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	resp, err := consulClient.Do(req)
+	if err != nil {
+		return nil, index, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, index, fmt.Errorf("%s", resp.Status)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, index, err
+	}
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	var list []PoolServer
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		w := e.Service.Weights.Passing
+		if w <= 0 {
+			w = 1
+		}
+		list = append(list, PoolServer{Address: net.JoinHostPort(host, strconv.Itoa(e.Service.Port)), Weight: w})
+	}
+	return list, next, nil
+}
+
+// watchConsul keeps the pool in sync with the healthy instances of its
+// Consul service.
+func (cfg *Config) watchConsul(p *Pool) {
+	var index uint64
+	for {
+		list, next, err := cfg.Consul.services(p.ConsulService, p.ConsulTag, index)
+		if err != nil {
+			log.Printf("pool %s: consul: %v", p.Name, err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		// a lower index means Consul was reset; start over
+		if next < index {
+			next = 0
+		}
+		index = next
+		cfg.updatePool(p, list, "consul")
+	}
+}
+
+func (cfg *Config) startDiscovery() {
+	for i := range cfg.Pools {
+		switch p := &cfg.Pools[i]; {
+		case p.ConsulService != "":
+			go cfg.watchConsul(p)
+		case p.KubeService != "":
+			go cfg.watchKubernetes(p)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CrowdSec connects to a CrowdSec local API. With a bouncer api_key the
+// ban decisions are pulled from the decision stream every update_seconds
+// and the listed addresses and ranges refused like the deny file. With
+// machine credentials a source reaching threshold refusals (the events of
+// the security log) within window_seconds is pushed back as an alert of
+// scenario, carrying a ban for ban_duration.
+type CrowdSec struct {
+	URL           string `toml:"url"`
+	APIKey        string `toml:"api_key"`
+	UpdateSeconds int    `toml:"update_seconds"`
+	MachineID     string `toml:"machine_id"`
+	Password      string `toml:"password"`
+	Scenario      string `toml:"scenario"`
+	Threshold     int    `toml:"threshold"`
+	WindowSeconds int    `toml:"window_seconds"`
+	BanDuration   string `toml:"ban_duration"`
+
+	client *http.Client
+}
+
+func (c *CrowdSec) enabled() bool {
+	return c.URL != ""
+}
+
+func (c *CrowdSec) init() error {
+	if c.APIKey == "" && c.MachineID == "" {
+		return fmt.Errorf("api_key or machine_id is required")
+	}
+	if c.UpdateSeconds < 1 || c.Threshold < 1 || c.WindowSeconds < 1 {
+		return fmt.Errorf("update_seconds, threshold and window_seconds must be positive")
+	}
+	ban, err := time.ParseDuration(c.BanDuration)
+	if err != nil || ban <= 0 {
+		return fmt.Errorf("ban_duration %q is not a positive duration", c.BanDuration)
+	}
+	c.URL = strings.TrimSuffix(c.URL, "/")
+	c.client = &http.Client{Timeout: 10 * time.Second}
+	if c.APIKey != "" {
+		go c.pull()
+	}
+	if c.MachineID != "" {
+		crowdsecOffences = newOffenceTracker(c.Threshold, time.Duration(c.WindowSeconds)*time.Second, ban)
+		go c.push()
+	}
+	return nil
+}
+
+// crowdsecBans is the current set of banned addresses and ranges.
+var crowdsecBans atomic.Pointer[prefixSet]
+
+// crowdsecAllowed reports whether no CrowdSec ban covers ip.
+func crowdsecAllowed(ip netip.Addr) bool {
+	s := crowdsecBans.Load()
+	return s == nil || !ip.IsValid() || !s.contains(ip.Unmap())
+}
+
+type crowdsecDecision struct {
+	Scope string `json:"scope"`
+	Value string `json:"value"`
+	Type  string `json:"type"`
+}
+
+// prefix returns the address or range a ban decision covers.
+func (d crowdsecDecision) prefix() (netip.Prefix, bool) {
+	if d.Type != "ban" {
+		return netip.Prefix{}, false
+	}
+	switch strings.ToLower(d.Scope) {
+	case "ip":
+		a, err := netip.ParseAddr(d.Value)
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		a = a.Unmap()
+		return netip.PrefixFrom(a, a.BitLen()), true
+	case "range":
+		p, err := netip.ParsePrefix(d.Value)
+		return p.Masked(), err == nil
+	}
+	return netip.Prefix{}, false
+}
+
+// pull follows the decision stream. The first successful request asks for
+// every active decision, the later ones only for the changes; the set in
+// use is swapped whole after each.
+func (c *CrowdSec) pull() {
+	banned := map[netip.Prefix]int{}
+	started := false
+	for ; ; time.Sleep(time.Duration(c.UpdateSeconds) * time.Second) {
+		var stream struct {
+			New     []crowdsecDecision `json:"new"`
+			Deleted []crowdsecDecision `json:"deleted"`
+		}
+		u := fmt.Sprintf("%s/v1/decisions/stream?startup=%v", c.URL, !started)
+		if err := c.get(u, &stream); err != nil {
+			log.Printf("crowdsec: decisions: %v", err)
+			continue
+		}
+		started = true
+		if len(stream.New) == 0 && len(stream.Deleted) == 0 {
+			continue
+		}
+		// the same value may be banned by several decisions at once
+		for _, d := range stream.New {
+			if p, ok := d.prefix(); ok {
+				banned[p]++
+			}
+		}
+		for _, d := range stream.Deleted {
+			if p, ok := d.prefix(); ok {
+				if banned[p]--; banned[p] <= 0 {
+					delete(banned, p)
+				}
+			}
+		}
+		s := &prefixSet{m: map[netip.Prefix]struct{}{}}
+		for p := range banned {
+			s.add(p)
+		}
+		crowdsecBans.Store(s)
+		log.Printf("crowdsec: %d banned (+%d -%d)", s.len(), len(stream.New), len(stream.Deleted))
+	}
+}
+
+func (c *CrowdSec) get(u string, v any) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Api-Key", c.APIKey)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// crowdsecOffences counts the refusals towards an alert.
+var crowdsecOffences *offenceTracker
+
+type crowdsecOffence struct {
+	ip     netip.Addr
+	reason string
+}
+
+// crowdsecAlerts queues the sources to report; when it is full, alerts are
+// dropped.
+var crowdsecAlerts = make(chan crowdsecOffence, 256)
+
+// record counts a refusal of ip and queues an alert at the threshold. The
+// reason is that of the refusal reaching it.
+func (c *CrowdSec) record(ip netip.Addr, reason string) {
+	if crowdsecOffences == nil || !crowdsecOffences.hit(ip) {
+		return
+	}
+	select {
+	case crowdsecAlerts <- crowdsecOffence{ip, reason}:
+	default:
+		log.Printf("crowdsec: queue full, not reporting %s", ip)
+	}
+}
+
+var crowdsecToken struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// login gets a machine token, reusing the current one until a minute
+// before it expires.
+func (c *CrowdSec) login() (string, error) {
+	t := &crowdsecToken
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Until(t.expires) > time.Minute {
+		return t.token, nil
+	}
+	body, _ := json.Marshal(map[string]any{
+		"machine_id": c.MachineID,
+		"password":   c.Password,
+		"scenarios":  []string{c.Scenario},
+	})
+	resp, err := c.client.Post(c.URL+"/v1/watchers/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("login: %s", resp.Status)
+	}
+	var v struct {
+		Token  string    `json:"token"`
+		Expire time.Time `json:"expire"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return "", fmt.Errorf("login: %v", err)
+	}
+	t.token, t.expires = v.Token, v.Expire
+	return t.token, nil
+}
+
+func (c *CrowdSec) push() {
+	for o := range crowdsecAlerts {
+		if err := c.alert(o); err != nil {
+			log.Printf("crowdsec: alert for %s: %v", o.ip, err)
+			continue
+		}
+		atomic.AddInt64(&crowdsecAlerted, 1)
+		log.Printf("crowdsec: reported %s (%s)", o.ip, o.reason)
+	}
+}
+
+// alert posts one alert with its ban decision.
+func (c *CrowdSec) alert(o crowdsecOffence) error {
+	token, err := c.login()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	ip := o.ip.String()
+	alert := map[string]any{
+		"scenario":         c.Scenario,
+		"scenario_hash":    "",
+		"scenario_version": "",
+		"message":          fmt.Sprintf("mcproxy: %s refused %d times within %ds (last: %s)", ip, c.Threshold, c.WindowSeconds, o.reason),
+		"events_count":     c.Threshold,
+		"start_at":         now,
+		"stop_at":          now,
+		"capacity":         c.Threshold,
+		"leakspeed":        fmt.Sprintf("%ds", c.WindowSeconds),
+		"simulated":        false,
+		"events": []map[string]any{{
+			"timestamp": now,
+			"meta":      []map[string]string{{"key": "source_ip", "value": ip}, {"key": "reason", "value": o.reason}},
+		}},
+		"source": map[string]string{"scope": "Ip", "value": ip, "ip": ip},
+		"decisions": []map[string]any{{
+			"origin":   "mcproxy",
+			"type":     "ban",
+			"scope":    "Ip",
+			"value":    ip,
+			"duration": c.BanDuration,
+			"scenario": c.Scenario,
+		}},
+	}
+	body, _ := json.Marshal([]any{alert})
+	req, err := http.NewRequest("POST", c.URL+"/v1/alerts", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		crowdsecToken.mu.Lock()
+		crowdsecToken.token = ""
+		crowdsecToken.mu.Unlock()
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
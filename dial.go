@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+var errDialBudget = errors.New("dial budget exhausted")
+
+// backendNetwork splits a backend address into the network and address to
+// dial: "unix:/path" is a unix socket, anything else TCP ("tls://" backends
+// get TLS on top in connectBackend).
+func backendNetwork(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", dialAddr(addr)
+}
+
+// dialBackend opens a connection to the backend; timeout, when set, caps
+// backend.dial_timeout_ms.
+func dialBackend(cfg *Config, addr string, cliAddr net.Addr, timeout time.Duration) (net.Conn, error) {
+	if t := time.Duration(cfg.Backend.DialTimeout) * time.Millisecond; timeout == 0 || (t > 0 && t < timeout) {
+		timeout = t
+	}
+	d := net.Dialer{Timeout: timeout}
+	cfg.Backend.KeepAlive.dialer(&d)
+	network, address := backendNetwork(addr)
+	var controls []controlFunc
+	if ip, _ := addrIPPort(cliAddr); cfg.Backend.Transparent && ip != nil && network == "tcp" {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+		controls = append(controls, transparentControl)
+	} else if cfg.Backend.bind != nil && network == "tcp" {
+		d.LocalAddr = &net.TCPAddr{IP: cfg.Backend.bind}
+	}
+	// health probes (no client) skip Fast Open: with a cookie cached the
+	// connect succeeds without reaching the backend at all
+	if cfg.Backend.FastOpen && cliAddr != nil && network == "tcp" {
+		controls = append(controls, fastOpenDialControl)
+	}
+	d.Control = chainControl(controls)
+	if cfg.Backend.Multipath && network == "tcp" {
+		d.SetMultipathTCP(true)
+	}
+	var c net.Conn
+	var err error
+	if cfg.Backend.upstream != nil && network == "tcp" {
+		c, err = dialUpstream(&d, cfg.Backend.upstream, address)
+	} else if network == "tcp" {
+		c, err = dialHappy(&d, address)
+	} else {
+		c, err = d.Dial(network, address)
+	}
+	if err != nil {
+		refreshBackend(addr)
+		return nil, err
+	}
+	cfg.Backend.Socket.set(c)
+	return c, nil
+}
+
+// connectBackend dials the backend and sends the configured PROXY header.
+func connectBackend(cfg *Config, addr string, cliAddr net.Addr, timeout time.Duration) (net.Conn, error) {
+	backend, err := dialBackend(cfg, addr, cliAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Backend.SendProxy != "off" {
+		dst := backend.LocalAddr()
+		if _, ok := dst.(*net.UnixAddr); ok {
+			dst = anyAddr(cliAddr)
+		}
+		hdr := proxyHeader(cfg.Backend.SendProxy, cliAddr, dst, cfg.Backend.ProxyTLVs)
+		if _, err = backend.Write(hdr); err != nil {
+			backend.Close()
+			return nil, err
+		}
+	}
+	// the PROXY header goes in the clear ahead of TLS, as HAProxy and
+	// stunnel expect it
+	if strings.HasPrefix(addr, "tls://") {
+		tc, err := cfg.Backend.TLS.client(backend, addr)
+		if err != nil {
+			backend.Close()
+			return nil, err
+		}
+		backend = tc
+	}
+	return backend, nil
+}
+
+// dialPool connects to addr and, when that fails, to other healthy members
+// of the pool, up to backend.dial_retries more attempts within
+// backend.dial_budget_ms. It returns the address that was connected.
+func (cfg *Config) dialPool(p *Pool, addr string, cliAddr net.Addr) (net.Conn, string, error) {
+	budget := time.Duration(cfg.Backend.DialBudgetMs) * time.Millisecond
+	deadline := time.Now().Add(budget)
+	if addr == "" {
+		return nil, addr, errNoServers
+	}
+	tried := map[string]bool{}
+	for attempt := 0; ; attempt++ {
+		var timeout time.Duration
+		if budget > 0 {
+			if timeout = time.Until(deadline); timeout <= 0 {
+				return nil, addr, errDialBudget
+			}
+		}
+		var backend net.Conn
+		err := errBackendDown
+		if backendHealthy(addr) && cfg.circuitAttempt(addr) {
+			backend, err = connectBackend(cfg, addr, cliAddr, timeout)
+			cfg.recordDial(addr, err)
+		}
+		if err == nil {
+			return backend, addr, nil
+		}
+		if attempt >= cfg.Backend.DialRetries {
+			return nil, addr, err
+		}
+		tried[addr] = true
+		next := p.pick(cliAddr, tried)
+		if next == "" {
+			return nil, addr, err
+		}
+		cfg.logf("%s: dial backend %s: %v; retrying on %s", cliAddr, addr, err, next)
+		addr = next
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// fallbackFor returns the pool that logins refused by p are handed to, or
+// nil when p is the fallback itself.
+func (cfg *Config) fallbackFor(p *Pool) *Pool {
+	if f := cfg.fallback; f != nil && f != p && f.Name != p.Name {
+		return f
+	}
+	return nil
+}
+
+// redial connects the login to another pool and replays its opening
+// packets there.
+func (cfg *Config) redial(p *Pool, cliAddr net.Addr, pending []byte) (net.Conn, string, error) {
+	c, addr, err := cfg.dialPool(p, p.pick(cliAddr, nil), cliAddr)
+	if err == nil && len(pending) > 0 {
+		if _, err = c.Write(pending); err != nil {
+			c.Close()
+		}
+	}
+	return c, addr, err
+}
+
+// firstRead waits for the backend's answer to a login. ok is false when the
+// backend closed the connection without sending anything; a backend that is
+// merely slow counts as answering.
+func firstRead(c net.Conn) (b []byte, ok bool) {
+	b = make([]byte, 4096)
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	n, err := c.Read(b)
+	c.SetReadDeadline(time.Time{})
+	var ne net.Error
+	if n == 0 && err != nil && !(errors.As(err, &ne) && ne.Timeout()) {
+		return nil, false
+	}
+	return b[:n], true
+}
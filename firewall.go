@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Firewall bans sources in the kernel: an address refused threshold times
+// within window_seconds (the events of the security log) is added to an
+// nftables set or an ipset for ban_seconds, so that its next connections
+// are dropped before they reach the accept loop. The sets and the rules
+// that drop their members are the operator's; mcproxy only adds elements.
+type Firewall struct {
+	Backend       string `toml:"backend"`
+	Table         string `toml:"table"`
+	Set           string `toml:"set"`
+	Set6          string `toml:"set6"`
+	Threshold     int    `toml:"threshold"`
+	WindowSeconds int    `toml:"window_seconds"`
+	BanSeconds    int    `toml:"ban_seconds"`
+}
+
+func (f *Firewall) enabled() bool {
+	return f.Backend != ""
+}
+
+func (f *Firewall) init() error {
+	switch f.Backend {
+	case "nftables":
+		if len(strings.Fields(f.Table)) != 2 {
+			return fmt.Errorf("table must be a family and a name, such as \"inet mcproxy\"")
+		}
+	case "ipset":
+	default:
+		return fmt.Errorf("unknown backend %q", f.Backend)
+	}
+	if f.Set == "" || f.Set6 == "" {
+		return fmt.Errorf("set and set6 are required")
+	}
+	if f.Threshold < 1 || f.WindowSeconds < 1 || f.BanSeconds < 0 {
+		return fmt.Errorf("threshold and window_seconds must be positive, ban_seconds not negative")
+	}
+	offences = newOffenceTracker(f.Threshold, time.Duration(f.WindowSeconds)*time.Second, f.ban())
+	go f.run()
+	return nil
+}
+
+// offences counts the refusals towards a firewall ban.
+var offences *offenceTracker
+
+type offence struct {
+	count  int
+	first  time.Time
+	banned time.Time
+}
+
+// offenceTracker counts the refusals of each source within a window and
+// tells when one reaches the threshold. An address that did is not
+// reported again until its ban has run out.
+type offenceTracker struct {
+	mu        sync.Mutex
+	m         map[netip.Addr]*offence
+	threshold int
+	window    time.Duration
+	ban       time.Duration
+}
+
+func newOffenceTracker(threshold int, window, ban time.Duration) *offenceTracker {
+	t := &offenceTracker{m: make(map[netip.Addr]*offence), threshold: threshold, window: window, ban: ban}
+	go t.sweep()
+	return t
+}
+
+// hit counts a refusal of ip and reports whether it is the one reaching
+// the threshold.
+func (t *offenceTracker) hit(ip netip.Addr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.m[ip]
+	if e == nil || time.Since(e.first) > t.window {
+		if e != nil && time.Since(e.banned) < t.ban {
+			return false
+		}
+		e = &offence{first: time.Now()}
+		t.m[ip] = e
+	}
+	if e.count++; e.count != t.threshold {
+		return false
+	}
+	e.banned = time.Now()
+	return true
+}
+
+// bans queues addresses for the command runner, so that a slow nft or
+// ipset never holds up a connection; when it is full, bans are dropped.
+var bans = make(chan netip.Addr, 256)
+
+// record counts a refusal of ip and queues its ban at the threshold.
+func (f *Firewall) record(ip netip.Addr) {
+	if offences == nil || !offences.hit(ip) {
+		return
+	}
+	select {
+	case bans <- ip:
+	default:
+		log.Printf("firewall: queue full, not banning %s", ip)
+	}
+}
+
+// ban is how long an entry stays; without ban_seconds it is for good.
+func (f *Firewall) ban() time.Duration {
+	if f.BanSeconds == 0 {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Duration(f.BanSeconds) * time.Second
+}
+
+func (t *offenceTracker) sweep() {
+	for {
+		time.Sleep(t.window)
+		t.mu.Lock()
+		for ip, e := range t.m {
+			if time.Since(e.first) > t.window && time.Since(e.banned) >= t.ban {
+				delete(t.m, ip)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (f *Firewall) run() {
+	for ip := range bans {
+		args := f.command(ip)
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			log.Printf("firewall: %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+			continue
+		}
+		atomic.AddInt64(&firewallBans, 1)
+		log.Printf("firewall: banned %s", ip)
+	}
+}
+
+// command is the nft or ipset invocation adding ip to its set.
+func (f *Firewall) command(ip netip.Addr) []string {
+	set := f.Set
+	if ip.Is6() {
+		set = f.Set6
+	}
+	if f.Backend == "ipset" {
+		args := []string{"ipset", "-exist", "add", set, ip.String()}
+		if f.BanSeconds > 0 {
+			args = append(args, "timeout", strconv.Itoa(f.BanSeconds))
+		}
+		return args
+	}
+	elem := ip.String()
+	if f.BanSeconds > 0 {
+		elem += " timeout " + strconv.Itoa(f.BanSeconds) + "s"
+	}
+	args := append([]string{"nft", "add", "element"}, strings.Fields(f.Table)...)
+	return append(args, set, "{ "+elem+" }")
+}
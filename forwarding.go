@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	velocityChannel    = "velocity:player_info"
+	velocityDefaultVer = 1
+
+	loginPluginRequest  = 0x04
+	loginPluginResponse = 0x02
+)
+
+// forwardable reports whether the client has an IP address to forward. A
+// client of a unix listener without a PROXY header has none, and the backend
+// must not be told "<nil>".
+func forwardable(cliAddr net.Addr) bool {
+	ip, _ := addrIPPort(cliAddr)
+	return ip != nil
+}
+
+// bungeeRewrite re-encodes the hello with the BungeeCord legacy forwarding
+// data (host\0ip\0uuid) in the server address field. Like BungeeCord, any
+// extra data the client put there (Forge markers) is dropped, since the
+// backend would otherwise read it as the properties field.
+func bungeeRewrite(h *clientHello, cliAddr net.Addr) []byte {
+	if h.hs.NextState != stateLogin {
+		return h.raw()
+	}
+	ip, _ := addrIPPort(cliAddr)
+	u := offlineUUID(h.login.Name)
+	hs := h.hs
+	host, _, _ := strings.Cut(hs.Host, "\x00")
+	hs.Host = host + "\x00" + ip.String() + "\x00" + hex.EncodeToString(u[:])
+	return append(hs.encode(), h.loginRaw...)
+}
+
+// velocityForward answers the backend's velocity:player_info login plugin
+// request with a signed player info payload. Packets that arrive before it
+// are relayed to the client; any other packet than a plugin request ends the
+// exchange (the backend is not in modern forwarding mode).
+func velocityForward(client io.Writer, backend net.Conn, h *clientHello, cliAddr net.Addr, secret []byte) error {
+	br := bufio.NewReader(backend)
+	backend.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer backend.SetReadDeadline(time.Time{})
+
+	for {
+		id, body, raw, err := readPacket(br, maxLoginLen*32)
+		if err != nil {
+			return err
+		}
+		if id != loginPluginRequest {
+			if _, err := client.Write(raw); err != nil {
+				return err
+			}
+			break
+		}
+		p := &packetReader{b: body}
+		msgID := p.varInt()
+		channel := p.string(256)
+		if p.err != nil {
+			return fmt.Errorf("plugin request: %v", p.err)
+		}
+		if channel != velocityChannel {
+			if _, err := client.Write(raw); err != nil {
+				return err
+			}
+			continue
+		}
+
+		resp := appendVarInt(nil, msgID)
+		resp = append(resp, 1)
+		resp = append(resp, velocityPayload(h, cliAddr, secret)...)
+		if _, err := backend.Write(framePacket(loginPluginResponse, resp)); err != nil {
+			return err
+		}
+		break
+	}
+
+	rest, _ := br.Peek(br.Buffered())
+	if len(rest) > 0 {
+		if _, err := client.Write(rest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func velocityPayload(h *clientHello, cliAddr net.Addr, secret []byte) []byte {
+	ip, _ := addrIPPort(cliAddr)
+	u := offlineUUID(h.login.Name)
+
+	data := appendVarInt(nil, velocityDefaultVer)
+	data = appendString(data, ip.String())
+	data = append(data, u[:]...)
+	data = appendString(data, h.login.Name)
+	data = appendVarInt(data, 0)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return append(mac.Sum(nil), data...)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// Framing holds clients to the Minecraft framing rules on their way to the
+// backend. The opening must be well formed: a hostname of at most max_host
+// bytes, a known next state and a Login Start that parses exactly for the
+// protocol. After it, a status client may only send a status request and
+// pings, and a login client's next frame may not pass max_packet bytes and
+// must be a packet the login state takes from its protocol; the frames after
+// that can be encrypted and are left to the backend. Whether that frame is
+// compressed is learnt from the backend's Set Compression.
+type Framing struct {
+	Enabled   bool `toml:"enabled"`
+	MaxPacket int  `toml:"max_packet"`
+	MaxHost   int  `toml:"max_host"`
+}
+
+// maxFrame is the largest frame length the protocol allows, 2^21-1: three
+// VarInt bytes.
+const maxFrame = 1<<21 - 1
+
+func (f *Framing) init() error {
+	if f.MaxPacket < 1 || f.MaxPacket > maxFrame {
+		return fmt.Errorf("max_packet must be between 1 and %d", maxFrame)
+	}
+	if f.MaxHost < 1 {
+		return fmt.Errorf("max_host must be positive")
+	}
+	return nil
+}
+
+// checkHello validates the opening of a connection.
+func (f *Framing) checkHello(h *clientHello) error {
+	host, _, _ := strings.Cut(h.hs.Host, "\x00")
+	switch {
+	case len(host) > f.MaxHost:
+		return fmt.Errorf("hostname of %d bytes", len(host))
+	case h.hs.NextState < 1 || h.hs.NextState > 3:
+		return fmt.Errorf("next state %d", h.hs.NextState)
+	case h.hs.NextState == stateLogin && h.login.malformed:
+		return fmt.Errorf("login start does not fit protocol %d", h.hs.Protocol)
+	}
+	return nil
+}
+
+// frameCheck follows the client's frames after its opening and fails the
+// stream on the first one that breaks the rules.
+type frameCheck struct {
+	r        io.Reader
+	status   bool
+	protocol int32
+	max      int
+	err      error
+
+	// set from the backend's side by loginWatch: the compression
+	// threshold, negative while it is off, and whether the client has
+	// gone where its frames cannot be told any more
+	threshold atomic.Int32
+	off       atomic.Bool
+
+	hdr, hdrLen   int  // frame length VarInt being read
+	length        int  // bytes left of a frame whose id is next
+	zipped        bool // the id is behind a data length
+	dlen, dlenLen int  // data length VarInt being read
+	skip          int  // bytes left of the current frame
+	done          bool
+}
+
+func (f *Framing) newFrameCheck(r io.Reader, hs handshake) *frameCheck {
+	c := &frameCheck{r: r, status: hs.NextState == stateStatus, protocol: hs.Protocol, max: f.MaxPacket}
+	c.threshold.Store(-1)
+	return c
+}
+
+func (c *frameCheck) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 && !c.done {
+		if c.err = c.check(p[:n]); c.err != nil {
+			return 0, c.err
+		}
+	}
+	return n, err
+}
+
+// loginIDAllowed reports whether a client may send the packet as its next
+// one after Login Start: Encryption Response, and from their versions on
+// Login Plugin Response (1.13), Login Acknowledged (1.20.2) and Cookie
+// Response (1.20.5).
+func loginIDAllowed(id byte, protocol int32) bool {
+	switch id {
+	case 0x01:
+		return true
+	case 0x02:
+		return protocol >= 393
+	case 0x03:
+		return protocol >= 764
+	case 0x04:
+		return protocol >= 766
+	}
+	return false
+}
+
+// check feeds the next bytes of the stream through the rules.
+func (c *frameCheck) check(b []byte) error {
+	if c.off.Load() {
+		c.done = true
+		return nil
+	}
+	for len(b) > 0 && !c.done {
+		switch {
+		case c.skip > 0:
+			k := min(c.skip, len(b))
+			c.skip -= k
+			b = b[k:]
+			c.done = c.skip == 0 && !c.status
+		case c.length > 0 && c.zipped:
+			v := b[0]
+			b = b[1:]
+			c.length--
+			c.dlen |= int(v&0x7f) << (7 * c.dlenLen)
+			if c.dlenLen++; v&0x80 != 0 {
+				if c.dlenLen == 5 || c.length == 0 {
+					return fmt.Errorf("bad data length")
+				}
+				continue
+			}
+			n, t := c.dlen, int(c.threshold.Load())
+			c.zipped, c.dlen, c.dlenLen = false, 0, 0
+			switch {
+			case c.length == 0:
+				return fmt.Errorf("frame of a data length alone")
+			case n == 0:
+				// under the threshold: the id follows uncompressed
+				continue
+			case n < t:
+				return fmt.Errorf("compressed packet of %d bytes under the threshold of %d", n, t)
+			}
+			// compressed, so the id is out of sight
+			c.skip, c.length = c.length, 0
+		case c.length > 0:
+			id := b[0]
+			b = b[1:]
+			n := c.length
+			c.length = 0
+			switch {
+			case c.status:
+				if n == 1 && id != 0x00 || n == 9 && id != 0x01 {
+					return fmt.Errorf("packet 0x%02x of %d bytes in status", id, n)
+				}
+			case !loginIDAllowed(id, c.protocol):
+				return fmt.Errorf("packet 0x%02x in login for protocol %d", id, c.protocol)
+			}
+			c.skip = n - 1
+			c.done = c.skip == 0 && !c.status
+		default:
+			v := b[0]
+			b = b[1:]
+			c.hdr |= int(v&0x7f) << (7 * c.hdrLen)
+			if c.hdrLen++; v&0x80 != 0 {
+				if c.hdrLen == 3 {
+					return fmt.Errorf("frame length over %d", maxFrame)
+				}
+				continue
+			}
+			n := c.hdr
+			c.hdr, c.hdrLen = 0, 0
+			switch {
+			case n == 0 || n > c.max:
+				return fmt.Errorf("frame of %d bytes", n)
+			case c.status && n != 1 && n != 9:
+				// a status request is the id alone, a ping the id and a long
+				return fmt.Errorf("frame of %d bytes in status", n)
+			}
+			c.length = n
+			c.zipped = c.threshold.Load() >= 0
+		}
+	}
+	return nil
+}
+
+// loginWatch reads what the backend sends a login client on its way there,
+// until encryption starts or the client leaves the login state, and tells
+// the client's frameCheck about it: compression once Set Compression
+// turns it on, and that the frames are past checking once the client goes
+// on to play, which before 1.20.2 happens straight after Login Success.
+type loginWatch struct {
+	w io.Writer
+	c *frameCheck
+
+	hdr, hdrLen int
+	length      int    // bytes left of a frame whose id is next
+	id          byte   // the id of the current frame
+	body        []byte // the threshold of Set Compression
+	skip        int    // bytes left of the current frame
+	done        bool
+}
+
+func (c *frameCheck) watch(w io.Writer) io.Writer {
+	return &loginWatch{w: w, c: c}
+}
+
+// Write follows b before passing it on, so the client cannot answer a
+// packet before this has seen it.
+func (l *loginWatch) Write(b []byte) (int, error) {
+	if !l.done {
+		l.follow(b)
+	}
+	return l.w.Write(b)
+}
+
+// watched login packets of the backend
+const (
+	loginDisconnectID  = 0x00
+	loginEncryptionReq = 0x01
+	loginSuccess       = 0x02
+	loginSetCompress   = 0x03
+	loginCookieRequest = 0x05
+)
+
+func (l *loginWatch) follow(b []byte) {
+	for len(b) > 0 && !l.done {
+		switch {
+		case l.skip > 0 && l.id == loginSetCompress:
+			k := min(l.skip, len(b))
+			l.body = append(l.body, b[:k]...)
+			l.skip -= k
+			b = b[k:]
+			if l.skip == 0 {
+				l.compression()
+			}
+		case l.skip > 0:
+			k := min(l.skip, len(b))
+			l.skip -= k
+			b = b[k:]
+		case l.length > 0:
+			l.id, l.skip = b[0], l.length-1
+			l.length = 0
+			b = b[1:]
+			switch l.id {
+			case loginPluginRequest, loginCookieRequest:
+				// the client answers with a login packet
+			case loginSetCompress:
+				if l.skip == 0 {
+					l.stop()
+				}
+			case loginSuccess:
+				if l.c.protocol < 764 {
+					l.c.off.Store(true)
+				}
+				l.done = true
+			case loginEncryptionReq, loginDisconnectID:
+				l.done = true
+			default:
+				l.stop()
+			}
+		default:
+			v := b[0]
+			b = b[1:]
+			l.hdr |= int(v&0x7f) << (7 * l.hdrLen)
+			if l.hdrLen++; v&0x80 != 0 {
+				if l.hdrLen == 3 {
+					l.stop()
+				}
+				continue
+			}
+			l.length = l.hdr
+			l.hdr, l.hdrLen = 0, 0
+			if l.length == 0 {
+				l.stop()
+			}
+		}
+	}
+}
+
+// compression applies a complete Set Compression. A negative threshold
+// leaves compression off.
+func (l *loginWatch) compression() {
+	p := &packetReader{b: l.body}
+	t := p.varInt()
+	switch {
+	case p.err != nil || len(p.b) > 0:
+		l.stop()
+	case t < 0:
+		l.body = nil
+	case l.c.protocol < 764:
+		// the client may be in play by its next frame, and Login Success
+		// is now out of sight
+		l.stop()
+	default:
+		l.c.threshold.Store(t)
+		l.done = true
+	}
+}
+
+// stop gives up on something this cannot follow and lets the client's
+// frames through unchecked.
+func (l *loginWatch) stop() {
+	l.c.off.Store(true)
+	l.done = true
+}
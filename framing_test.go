@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// frame prefixes body with its length.
+func frame(body ...byte) []byte {
+	return append(appendVarInt(nil, int32(len(body))), body...)
+}
+
+// zframe is a frame after Set Compression: data length, then body.
+func zframe(dataLen int32, body ...byte) []byte {
+	return frame(append(appendVarInt(nil, dataLen), body...)...)
+}
+
+func TestFrameCheckLogin(t *testing.T) {
+	f := Framing{MaxPacket: maxFrame, MaxHost: 255}
+	payload := bytes.Repeat([]byte{0xaa}, 100)
+	tests := []struct {
+		name     string
+		protocol int32
+		backend  []byte // what the backend sent first
+		client   []byte
+		ok       bool
+	}{
+		{"encryption response", 765, framePacket(0x01, nil), framePacket(0x01, payload), true},
+		{"plugin response", 760, framePacket(0x04, []byte{1}), framePacket(0x02, []byte{1, 0}), true},
+		{"plugin response before 1.13", 340, framePacket(0x04, []byte{1}), framePacket(0x02, []byte{1, 0}), false},
+		{"login acknowledged", 765, nil, framePacket(0x03, nil), true},
+		{"cookie response before 1.20.5", 765, nil, framePacket(0x04, nil), false},
+		{"play packet in login", 765, nil, framePacket(0x07, payload), false},
+		{"oversized", 765, nil, framePacket(0x01, make([]byte, maxFrame)), false},
+		{"disabled compression", 765, framePacket(0x03, appendVarInt(nil, -1)), framePacket(0x64, nil), false},
+
+		{"threshold 64, compressed", 765, framePacket(0x03, []byte{64}), zframe(100, payload[:40]...), true},
+		{"threshold 64, compressed at the threshold", 765, framePacket(0x03, []byte{64}), zframe(64, payload[:30]...), true},
+		{"threshold 64, plain ack", 765, framePacket(0x03, []byte{64}), zframe(0, 0x03), true},
+		{"threshold 64, plain bad id", 765, framePacket(0x03, []byte{64}), zframe(0, 0x07, 1, 2), false},
+		{"threshold 64, compressed under it", 765, framePacket(0x03, []byte{64}), zframe(10, payload[:8]...), false},
+		{"threshold 64, data length alone", 765, framePacket(0x03, []byte{64}), frame(0x64), false},
+		{"threshold 300", 765, framePacket(0x03, appendVarInt(nil, 300)), zframe(400, payload[:50]...), true},
+		{"without compression a data length is an id", 765, nil, zframe(100, payload[:40]...), false},
+
+		{"play after login success before 1.20.2", 763, framePacket(0x02, payload[:20]), framePacket(0x07, payload), true},
+		{"compression before 1.20.2", 763, framePacket(0x03, []byte{64}), zframe(0, 0x12, 1), true},
+		{"login success from 1.20.2", 765, framePacket(0x02, payload[:20]), framePacket(0x07, payload), false},
+		{"unknown backend packet", 765, framePacket(0x09, nil), framePacket(0x07, payload), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := f.newFrameCheck(nil, handshake{Protocol: tt.protocol, NextState: stateLogin})
+			down := c.watch(io.Discard)
+			// the backend's packets split mid-frame, as TCP may deliver them
+			for _, b := range [][]byte{tt.backend[:len(tt.backend)/2], tt.backend[len(tt.backend)/2:]} {
+				down.Write(b)
+			}
+			var err error
+			for i := range tt.client {
+				if err = c.check(tt.client[i : i+1]); err != nil {
+					break
+				}
+			}
+			if ok := err == nil; ok != tt.ok {
+				t.Errorf("check = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && !c.done {
+				t.Error("frame checked but not done")
+			}
+		})
+	}
+}
+
+func TestFrameCheckStatus(t *testing.T) {
+	f := Framing{MaxPacket: maxFrame, MaxHost: 255}
+	ping := framePacket(0x01, make([]byte, 8))
+	tests := []struct {
+		name   string
+		client []byte
+		ok     bool
+	}{
+		{"request and ping", append(framePacket(0x00, nil), ping...), true},
+		{"ping with a short long", framePacket(0x01, make([]byte, 4)), false},
+		{"request with a body", framePacket(0x00, []byte{1}), false},
+		{"ping id on a request", framePacket(0x01, nil), false},
+		{"four byte length", []byte{0xff, 0xff, 0xff, 0x01}, false},
+		{"empty frame", []byte{0}, false},
+	}
+	for _, tt := range tests {
+		c := f.newFrameCheck(nil, handshake{Protocol: 765, NextState: stateStatus})
+		if err := c.check(tt.client); (err == nil) != tt.ok {
+			t.Errorf("%s: check = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type GeoIP struct {
+	Database      string `toml:"database"`
+	ASNDatabase   string `toml:"asn_database"`
+	ReloadSeconds int    `toml:"reload_seconds"`
+}
+
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+}
+
+type asnRecord struct {
+	Number uint32 `maxminddb:"autonomous_system_number"`
+}
+
+var geoDB, asnDB atomic.Pointer[maxminddb.Reader]
+
+func openGeoIP(db *atomic.Pointer[maxminddb.Reader], path string) error {
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		return err
+	}
+	db.Store(r)
+	return nil
+}
+
+// watch reopens a database when its file changes, so that a fresh
+// GeoLite2 download takes effect without a restart. The old reader is
+// closed a minute later, once lookups in flight are done with it.
+func (g *GeoIP) watch(db *atomic.Pointer[maxminddb.Reader], path string) {
+	var mod time.Time
+	if fi, err := os.Stat(path); err == nil {
+		mod = fi.ModTime()
+	}
+	for range time.Tick(time.Duration(g.ReloadSeconds) * time.Second) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Printf("geoip: %v", err)
+			continue
+		}
+		if fi.ModTime().Equal(mod) {
+			continue
+		}
+		old := db.Load()
+		if err := openGeoIP(db, path); err != nil {
+			log.Printf("geoip: reload: %v", err)
+			continue
+		}
+		mod = fi.ModTime()
+		log.Printf("geoip: reloaded %s", path)
+		time.AfterFunc(time.Minute, func() { old.Close() })
+	}
+}
+
+// geoCountry returns the ISO country code of ip, or "" when no database is
+// loaded or the address has no country.
+func geoCountry(ip netip.Addr) string {
+	db := geoDB.Load()
+	if db == nil || !ip.IsValid() {
+		return ""
+	}
+	var rec geoRecord
+	if db.Lookup(ip.AsSlice(), &rec) != nil {
+		return ""
+	}
+	return rec.Country.ISOCode
+}
+
+// geoAllowed applies the listener's country lists to ip. Addresses the
+// database places in no country, such as private ones, are let through.
+func (l *Listener) geoAllowed(ip netip.Addr) bool {
+	if len(l.AllowCountries) == 0 && len(l.DenyCountries) == 0 {
+		return true
+	}
+	c := geoCountry(ip)
+	switch {
+	case c == "":
+		return true
+	case slices.Contains(l.DenyCountries, c):
+		return false
+	}
+	return len(l.AllowCountries) == 0 || slices.Contains(l.AllowCountries, c)
+}
+
+// geoASN returns the autonomous system number of ip, or 0 when no ASN
+// database is loaded or the address is not announced.
+func geoASN(ip netip.Addr) uint32 {
+	db := asnDB.Load()
+	if db == nil || !ip.IsValid() {
+		return 0
+	}
+	var rec asnRecord
+	if db.Lookup(ip.AsSlice(), &rec) != nil {
+		return 0
+	}
+	return rec.Number
+}
+
+// asnAllowed reports whether ip is outside the listener's deny_asns.
+func (l *Listener) asnAllowed(ip netip.Addr) bool {
+	if len(l.DenyASNs) == 0 {
+		return true
+	}
+	n := geoASN(ip)
+	return n == 0 || !slices.Contains(l.DenyASNs, n)
+}
+
+func upperAll(list []string) []string {
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = strings.ToUpper(strings.TrimSpace(s))
+	}
+	return out
+}
+
+// geoLookup returns the ISO country and continent codes for the address,
+// or empty strings when no database is loaded or the address is unknown.
+func geoLookup(a net.Addr) (country, continent string) {
+	db := geoDB.Load()
+	if db == nil {
+		return "", ""
+	}
+	ip, _ := addrIPPort(a)
+	var rec geoRecord
+	if ip == nil || db.Lookup(ip, &rec) != nil {
+		return "", ""
+	}
+	return rec.Country.ISOCode, rec.Continent.Code
+}
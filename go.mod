@@ -2,4 +2,10 @@ module mcproxy
 
 go 1.24.4
 
-require github.com/pelletier/go-toml/v2 v2.2.1
+require (
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/pelletier/go-toml/v2 v2.2.1
+	golang.org/x/net v0.26.0
+	golang.org/x/sys v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
+)
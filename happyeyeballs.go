@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// preferIPv4 and eyeballsDelay are set from backend.prefer_family and
+// backend.happy_eyeballs_delay_ms.
+var (
+	preferIPv4    bool
+	eyeballsDelay = 250 * time.Millisecond
+)
+
+var errNoAddrs = errors.New("no usable addresses")
+
+// byFamily splits addresses into the preferred family and the other one,
+// keeping the resolver's order within each.
+func byFamily(ips []net.IPAddr) (first, second []net.IP) {
+	for _, ip := range ips {
+		if (ip.IP.To4() != nil) == preferIPv4 {
+			first = append(first, ip.IP)
+		} else {
+			second = append(second, ip.IP)
+		}
+	}
+	return first, second
+}
+
+// dialHappy dials a TCP backend. A host name with both A and AAAA records is
+// raced RFC 8305 style: the preferred family is tried first, and the other
+// one starts after happy_eyeballs_delay_ms, or as soon as the first has
+// failed, so a broken IPv6 path costs a fraction of a second instead of the
+// whole connect timeout.
+func dialHappy(d *net.Dialer, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.Dial("tcp", address)
+	}
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if d.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+	}
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	first, second := byFamily(ips)
+	if local, ok := d.LocalAddr.(*net.TCPAddr); ok {
+		// a bound source address only reaches its own family
+		if (local.IP.To4() != nil) != preferIPv4 {
+			first, second = second, nil
+		} else {
+			second = nil
+		}
+	}
+	if len(first) == 0 {
+		first, second = second, nil
+	}
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan result, 2)
+	failed := make(chan struct{})
+	try := func(list []net.IP) result {
+		err := errNoAddrs
+		for _, ip := range list {
+			c, e := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+			if e == nil {
+				return result{c, nil}
+			}
+			err = e
+		}
+		return result{nil, err}
+	}
+	go func() {
+		r := try(first)
+		if r.err != nil {
+			close(failed)
+		}
+		results <- r
+	}()
+	racing := len(second) > 0
+	if racing {
+		go func() {
+			t := time.NewTimer(eyeballsDelay)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-failed:
+			case <-ctx.Done():
+				results <- result{nil, ctx.Err()}
+				return
+			}
+			results <- try(second)
+		}()
+	}
+
+	var firstErr error
+	for n := 0; n < 1 || racing && n < 2; n++ {
+		r := <-results
+		if r.err == nil {
+			if racing && n == 0 {
+				// the loser may still connect after we give up on it
+				go func() {
+					if r := <-results; r.c != nil {
+						r.c.Close()
+					}
+				}()
+			}
+			return r.c, nil
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errBackendDown = errors.New("backend marked unhealthy")
+
+type HealthCheck struct {
+	IntervalSeconds int    `toml:"interval_seconds"`
+	TimeoutMs       int    `toml:"timeout_ms"`
+	Mode            string `toml:"mode"`
+	Rise            int    `toml:"rise"`
+	Fall            int    `toml:"fall"`
+	MaxLatencyMs    int    `toml:"max_latency_ms"`
+	Protocol        int32  `toml:"protocol"`
+	Host            string `toml:"host"`
+}
+
+type backendState struct {
+	healthy atomic.Bool
+	active  atomic.Int64
+
+	openUntil atomic.Int64
+	probing   atomic.Bool
+
+	mu      sync.Mutex
+	lastErr error
+	lastRTT time.Duration
+	since   time.Time
+	run     int
+	fails   int
+	players statusPlayers
+	polled  bool
+}
+
+var backendStates sync.Map
+
+func stateOf(addr string) *backendState {
+	v, ok := backendStates.Load(addr)
+	if !ok {
+		st := &backendState{}
+		st.healthy.Store(true)
+		v, _ = backendStates.LoadOrStore(addr, st)
+	}
+	return v.(*backendState)
+}
+
+// backendHealthy reports the last probe result and the circuit breaker;
+// backends that are not probed are healthy unless their circuit is open.
+func backendHealthy(addr string) bool {
+	v, ok := backendStates.Load(addr)
+	if !ok {
+		return true
+	}
+	st := v.(*backendState)
+	return st.healthy.Load() && !st.circuitOpen()
+}
+
+// backendAddrs lists every distinct TCP backend referenced by the config.
+func (cfg *Config) backendAddrs() []string {
+	seen := map[string]bool{}
+	var addrs []string
+	add := func(p *Pool) {
+		for _, s := range p.servers() {
+			if !seen[s.Address] {
+				seen[s.Address] = true
+				addrs = append(addrs, s.Address)
+			}
+		}
+	}
+	add(cfg.defaultPool)
+	if cfg.fallback != nil {
+		add(cfg.fallback)
+	}
+	for i := range cfg.VHosts {
+		add(cfg.VHosts[i].pool)
+	}
+	for i := range cfg.Rules {
+		if p := cfg.Rules[i].pool; p != nil {
+			add(p)
+		}
+	}
+	for i := range cfg.Listeners {
+		if p := cfg.Listeners[i].pool; p != nil {
+			add(p)
+		}
+	}
+	for i := range cfg.Pools {
+		add(&cfg.Pools[i])
+		if c := cfg.Pools[i].canary; c != nil {
+			add(c)
+		}
+	}
+	return addrs
+}
+
+var probing sync.Map
+
+func (cfg *Config) startHealthChecks() {
+	for _, addr := range cfg.backendAddrs() {
+		cfg.watchBackend(addr)
+	}
+	if cfg.Health.IntervalSeconds <= 0 {
+		return
+	}
+	interval := time.Duration(cfg.Health.IntervalSeconds) * time.Second
+	probes, _ := cfg.udpProbes()
+	for addr, probe := range probes {
+		if probe == "none" {
+			continue
+		}
+		go func() {
+			for {
+				cfg.probeUDP(addr, probe)
+				time.Sleep(interval)
+			}
+		}()
+	}
+}
+
+// watchBackend starts the probe loop of a backend unless it is running
+// already. The loop ends once the backend drops out of every pool.
+func (cfg *Config) watchBackend(addr string) {
+	if cfg.Health.IntervalSeconds <= 0 {
+		return
+	}
+	if _, running := probing.LoadOrStore(addr, true); running {
+		return
+	}
+	interval := time.Duration(cfg.Health.IntervalSeconds) * time.Second
+	go func() {
+		for slices.Contains(cfg.backendAddrs(), addr) {
+			cfg.probe(addr, stateOf(addr))
+			time.Sleep(interval)
+		}
+		probing.Delete(addr)
+	}()
+}
+
+// probe checks the backend with a TCP connect or a full status handshake
+// and updates its health once rise successes or fall failures in a row
+// have been seen.
+func (cfg *Config) probe(addr string, st *backendState) {
+	timeout := time.Duration(cfg.Health.TimeoutMs) * time.Millisecond
+	var doc statusDoc
+	var rtt time.Duration
+	var err error
+	if cfg.Health.Mode == "tcp" {
+		start := time.Now()
+		var c net.Conn
+		if c, err = dialBackend(cfg, addr, nil, timeout); err == nil {
+			rtt = time.Since(start)
+			c.Close()
+		}
+	} else {
+		host, port, _ := net.SplitHostPort(strings.TrimPrefix(addr, "tls://"))
+		switch {
+		case isSRV(addr):
+			_, port, _ = net.SplitHostPort(dialAddr(addr))
+			host = srvDomain(addr)
+		case strings.HasPrefix(addr, "unix:"):
+			host, port = "localhost", "25565"
+		}
+		if cfg.Health.Host != "" {
+			host = cfg.Health.Host
+		}
+		p, _ := strconv.Atoi(port)
+		hs := handshake{Protocol: cfg.Health.Protocol, Host: host, Port: uint16(p), NextState: stateStatus}
+
+		var js string
+		js, rtt, err = queryStatus(cfg, addr, hs, nil, timeout)
+		if err == nil {
+			if jerr := json.Unmarshal([]byte(js), &doc); jerr != nil {
+				err = fmt.Errorf("status json: %v", jerr)
+			}
+		}
+		if err == nil {
+			recordLatency(addr, rtt)
+		}
+	}
+	if err == nil {
+		if max := time.Duration(cfg.Health.MaxLatencyMs) * time.Millisecond; max > 0 && rtt > max {
+			err = fmt.Errorf("ping %v exceeds %v", rtt.Round(time.Millisecond), max)
+		}
+	}
+
+	var players *statusPlayers
+	if err == nil && cfg.Health.Mode == "status" {
+		players = &doc.Players
+	}
+	cfg.setHealth(addr, st, err, rtt, players)
+}
+
+// setHealth records a probe result, with the player counts it carried if
+// any, and flips the backend's health after rise or fall results in a row.
+func (cfg *Config) setHealth(addr string, st *backendState, err error, rtt time.Duration, players *statusPlayers) {
+	up := err == nil
+	st.mu.Lock()
+	st.lastErr, st.lastRTT = err, rtt
+	if players != nil {
+		st.players, st.polled = *players, true
+	}
+	if up == st.healthy.Load() {
+		st.run = 0
+	} else {
+		st.run++
+	}
+	need := cfg.Health.Fall
+	if up {
+		need = cfg.Health.Rise
+	}
+	flip := st.run >= need
+	if flip {
+		st.run = 0
+		st.since = time.Now()
+		st.healthy.Store(up)
+	}
+	st.mu.Unlock()
+
+	if flip {
+		if up {
+			log.Printf("backend %s is up", addr)
+		} else {
+			log.Printf("backend %s is down: %v", addr, err)
+		}
+	}
+}
+
+// upFor reports how long the backend has been healthy; backends that never
+// changed state count as healthy forever.
+func upFor(addr string) time.Duration {
+	v, ok := backendStates.Load(addr)
+	if !ok {
+		return math.MaxInt64
+	}
+	st := v.(*backendState)
+	if !st.healthy.Load() {
+		return 0
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.since.IsZero() {
+		return math.MaxInt64
+	}
+	return time.Since(st.since)
+}
+
+func healthReport() []string {
+	var lines []string
+	backendStates.Range(func(k, v any) bool {
+		st := v.(*backendState)
+		st.mu.Lock()
+		line := fmt.Sprintf("%s healthy=%v active=%d", k, st.healthy.Load(), st.active.Load())
+		if st.circuitOpen() {
+			line += " circuit=open"
+		}
+		if st.polled {
+			line += fmt.Sprintf(" players=%d/%d", st.players.Online, st.players.Max)
+		}
+		if st.lastErr != nil {
+			line += fmt.Sprintf(" error=%q", st.lastErr)
+		} else if st.lastRTT > 0 {
+			line += fmt.Sprintf(" ping=%v", st.lastRTT.Round(time.Microsecond))
+		}
+		st.mu.Unlock()
+		lines = append(lines, line)
+		return true
+	})
+	sort.Strings(lines)
+	return lines
+}
+
+// udpStateKey is the health state name of a UDP backend; the prefix keeps
+// it apart from a TCP backend on the same address.
+func udpStateKey(addr string) string {
+	return "udp://" + addr
+}
+
+// udpBackendAddrs lists the backends and fallbacks of the UDP listeners.
+func (cfg *Config) udpBackendAddrs() []string {
+	var addrs []string
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		if l.Protocol != "udp" {
+			continue
+		}
+		for _, a := range l.Backends {
+			if !slices.Contains(addrs, a) {
+				addrs = append(addrs, a)
+			}
+		}
+		if a := l.UDPFallback; a != "" && !slices.Contains(addrs, a) {
+			addrs = append(addrs, a)
+		}
+	}
+	for _, r := range cfg.Rules {
+		if r.Protocol == "udp" && r.Backend != "" && !slices.Contains(addrs, r.Backend) {
+			addrs = append(addrs, r.Backend)
+		}
+	}
+	return addrs
+}
+
+func validUDPProbe(probe string) bool {
+	return probe == "raknet" || probe == "port" || probe == "none"
+}
+
+// udpProbes maps each UDP backend to the udp_probe of the listeners using
+// it; backends of UDP route rules get backend.udp_probe.
+func (cfg *Config) udpProbes() (map[string]string, error) {
+	m := map[string]string{}
+	add := func(addr, probe string) error {
+		if p, ok := m[addr]; ok && p != probe {
+			return fmt.Errorf("udp backend %s: udp_probe is both %q and %q", addr, p, probe)
+		}
+		m[addr] = probe
+		return nil
+	}
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		if l.Protocol != "udp" {
+			continue
+		}
+		for _, a := range l.Backends {
+			if err := add(a, l.UDPProbe); err != nil {
+				return nil, err
+			}
+		}
+		if l.UDPFallback != "" {
+			if err := add(l.UDPFallback, l.UDPProbe); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, r := range cfg.Rules {
+		if r.Protocol == "udp" && r.Backend != "" {
+			if err := add(r.Backend, cfg.Backend.UDPProbe); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// probeUDP checks a UDP backend. The raknet probe sends an unconnected
+// ping and waits for the pong. The port probe is for servers that ignore
+// what they do not understand, such as voice chat: it sends a single byte
+// and only an ICMP port unreachable counts as a failure.
+func (cfg *Config) probeUDP(addr, probe string) {
+	timeout := time.Duration(cfg.Health.TimeoutMs) * time.Millisecond
+	start := time.Now()
+	err := func() error {
+		c, err := cfg.dialUDP(addr)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		var p []byte
+		if cfg.Backend.SendProxyUDP == "v2" {
+			p = proxyV2(c.LocalAddr(), c.RemoteAddr(), cfg.Backend.ProxyTLVs)
+		}
+		if probe == "port" {
+			p = append(p, 0)
+		} else {
+			p = append(p, raknetUnconnectedPing)
+			p = binary.BigEndian.AppendUint64(p, uint64(start.UnixMilli()))
+			p = append(p, raknetMagic...)
+			p = append(p, make([]byte, 8)...)
+		}
+		if _, err := c.Write(p); err != nil {
+			return err
+		}
+		c.SetReadDeadline(start.Add(timeout))
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := c.Read(buf)
+			if probe == "port" {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					return nil
+				}
+				return err
+			}
+			if err != nil {
+				return err
+			}
+			if _, _, ok := parsePong(buf[:n]); ok {
+				recordPong(addr, buf[:n])
+				return nil
+			}
+		}
+	}()
+	rtt := time.Since(start)
+	if probe == "port" {
+		// silence is the usual answer, and says nothing about latency
+		rtt = 0
+	}
+	if max := time.Duration(cfg.Health.MaxLatencyMs) * time.Millisecond; err == nil && max > 0 && rtt > max {
+		err = fmt.Errorf("ping %v exceeds %v", rtt.Round(time.Millisecond), max)
+	}
+	cfg.setHealth(udpStateKey(addr), stateOf(udpStateKey(addr)), err, rtt, nil)
+}
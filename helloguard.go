@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var errSlowHello = errors.New("opening sent below hello_min_rate")
+
+// helloGuard holds a client to the listener's budget for its opening, the
+// PROXY header, handshake and Login Start: the whole of it within
+// hello_timeout_ms of accept, and, once the first second after its first
+// byte is over, at least hello_min_rate bytes a second on average. It
+// reads the connection for the client's bufio.Reader; after done it just
+// passes the data on.
+type helloGuard struct {
+	conn  net.Conn
+	rate  int
+	first time.Time
+	n     int
+	over  bool
+	timer *time.Timer
+	fired atomic.Bool
+	slow  bool
+}
+
+func (l *Listener) guardHello(c net.Conn) *helloGuard {
+	g := &helloGuard{conn: c, rate: l.HelloMinRate}
+	if l.HelloTimeoutMs > 0 {
+		g.timer = time.AfterFunc(time.Duration(l.HelloTimeoutMs)*time.Millisecond, func() {
+			g.fired.Store(true)
+			c.Close()
+		})
+	}
+	return g
+}
+
+func (g *helloGuard) Read(p []byte) (int, error) {
+	n, err := g.conn.Read(p)
+	if g.over || g.rate == 0 || n == 0 {
+		return n, err
+	}
+	now := time.Now()
+	if g.first.IsZero() {
+		g.first = now
+	}
+	g.n += n
+	if d := now.Sub(g.first); d > time.Second && float64(g.n) < d.Seconds()*float64(g.rate) {
+		g.slow = true
+		return n, errSlowHello
+	}
+	return n, err
+}
+
+// done ends the budget once the opening is in. It is false when the
+// timer closed the connection first.
+func (g *helloGuard) done() bool {
+	g.over = true
+	if g.timer != nil && !g.timer.Stop() {
+		return false
+	}
+	return true
+}
+
+// tripped reports whether the connection failed its budget.
+func (g *helloGuard) tripped() bool {
+	return g.slow || g.fired.Load()
+}
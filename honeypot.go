@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+type Honeypot struct {
+	Enabled       bool   `toml:"enabled"`
+	Threshold     int    `toml:"threshold"`
+	WindowSeconds int    `toml:"window_seconds"`
+	MOTD          string `toml:"motd"`
+	Version       string `toml:"version"`
+	Online        int    `toml:"online"`
+	Max           int    `toml:"max"`
+}
+
+type scanEntry struct {
+	pings  int
+	logins int
+	first  time.Time
+}
+
+// scanTracker counts status pings and logins per source address. A source
+// that keeps pinging without ever logging in is treated as a scanner.
+type scanTracker struct {
+	mu sync.Mutex
+	m  map[netip.Addr]*scanEntry
+}
+
+var scanners = &scanTracker{m: make(map[netip.Addr]*scanEntry)}
+
+func sourceIP(a net.Addr) netip.Addr {
+	ip, _ := addrIPPort(a)
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
+
+// observe records a connection and reports whether the source has crossed
+// the scanner threshold.
+func (t *scanTracker) observe(h *Honeypot, a net.Addr, state int32) bool {
+	ip := sourceIP(a)
+	window := time.Duration(h.WindowSeconds) * time.Second
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.m[ip]
+	if e == nil || time.Since(e.first) > window {
+		e = &scanEntry{first: time.Now()}
+		t.m[ip] = e
+	}
+	if state == stateLogin {
+		e.logins++
+		return false
+	}
+	e.pings++
+	return e.logins == 0 && e.pings >= h.Threshold
+}
+
+func (t *scanTracker) sweep(window time.Duration) {
+	for {
+		time.Sleep(window)
+		t.mu.Lock()
+		for ip, e := range t.m {
+			if time.Since(e.first) > window {
+				delete(t.m, ip)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// decoyStatus is a plausible status answer for scanners. It echoes the
+// client's protocol so the entry looks joinable.
+func (h *Honeypot) decoyStatus(hs handshake) string {
+	d := statusDoc{
+		Version:     statusVersion{Name: h.Version, Protocol: hs.Protocol},
+		Players:     statusPlayers{Online: h.Online, Max: h.Max},
+		Description: json.RawMessage(chatJSON(h.MOTD)),
+	}
+	b, _ := json.Marshal(d)
+	return string(b)
+}
+
+func logScanner(cliAddr net.Addr, hs handshake) {
+	log.Printf("%s: scanner: protocol=%d host=%q port=%d", cliAddr, hs.Protocol, hs.Host, hs.Port)
+}
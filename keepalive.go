@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// KeepAlive tunes TCP keepalive probes; zero values keep Go's defaults of
+// 15 seconds idle, 15 seconds between probes and 9 probes.
+type KeepAlive struct {
+	Enabled         bool `toml:"enabled"`
+	IdleSeconds     int  `toml:"idle_seconds"`
+	IntervalSeconds int  `toml:"interval_seconds"`
+	Count           int  `toml:"count"`
+}
+
+func (k *KeepAlive) config() net.KeepAliveConfig {
+	return net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     time.Duration(k.IdleSeconds) * time.Second,
+		Interval: time.Duration(k.IntervalSeconds) * time.Second,
+		Count:    k.Count,
+	}
+}
+
+// set applies the settings to an accepted client connection.
+func (k *KeepAlive) set(c net.Conn) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if !k.Enabled {
+		tc.SetKeepAlive(false)
+		return
+	}
+	tc.SetKeepAliveConfig(k.config())
+}
+
+// dialer applies the settings to backend dials.
+func (k *KeepAlive) dialer(d *net.Dialer) {
+	if !k.Enabled {
+		d.KeepAlive = -1
+		return
+	}
+	d.KeepAliveConfig = k.config()
+}
+
+func (k *KeepAlive) valid() bool {
+	return k.IdleSeconds >= 0 && k.IntervalSeconds >= 0 && k.Count >= 0
+}
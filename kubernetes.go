@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+type Kubernetes struct {
+	Kubeconfig string `toml:"kubeconfig"`
+
+	client *kubeClient
+}
+
+type kubeClient struct {
+	server    string
+	token     string
+	namespace string
+	http      *http.Client
+}
+
+// init connects with the kubeconfig when one is set, otherwise with the
+// pod's service account.
+func (k *Kubernetes) init() error {
+	var err error
+	if k.Kubeconfig != "" {
+		k.client, err = loadKubeconfig(k.Kubeconfig)
+	} else {
+		k.client, err = loadInCluster()
+	}
+	return err
+}
+
+func loadInCluster() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a cluster; set kubernetes.kubeconfig")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	ns, _ := os.ReadFile(serviceAccountDir + "/namespace")
+	conf := &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: x509.NewCertPool()}
+	conf.RootCAs.AppendCertsFromPEM(ca)
+	return &kubeClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		token:     strings.TrimSpace(string(token)),
+		namespace: strings.TrimSpace(string(ns)),
+		http:      &http.Client{Transport: &http.Transport{TLSClientConfig: conf}},
+	}, nil
+}
+
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server   string `yaml:"server"`
+			CA       string `yaml:"certificate-authority"`
+			CAData   string `yaml:"certificate-authority-data"`
+			Insecure bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token      string `yaml:"token"`
+			TokenFile  string `yaml:"tokenFile"`
+			Cert       string `yaml:"client-certificate"`
+			CertData   string `yaml:"client-certificate-data"`
+			Key        string `yaml:"client-key"`
+			KeyData    string `yaml:"client-key-data"`
+			ExecConfig any    `yaml:"exec"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// kubeData returns inline base64 data, or the contents of the referenced file.
+func kubeData(data, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return os.ReadFile(file)
+	}
+	return nil, nil
+}
+
+// loadKubeconfig uses the current context of a kubeconfig file. Token and
+// client certificate users are supported; exec plugins are not.
+func loadKubeconfig(path string) (*kubeClient, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(b, &kc); err != nil {
+		return nil, err
+	}
+	c := &kubeClient{}
+	var cluster, user string
+	for _, x := range kc.Contexts {
+		if x.Name == kc.CurrentContext {
+			cluster, user, c.namespace = x.Context.Cluster, x.Context.User, x.Context.Namespace
+		}
+	}
+	if cluster == "" {
+		return nil, fmt.Errorf("context %q not found", kc.CurrentContext)
+	}
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	for _, x := range kc.Clusters {
+		if x.Name != cluster {
+			continue
+		}
+		c.server = strings.TrimSuffix(x.Cluster.Server, "/")
+		conf.InsecureSkipVerify = x.Cluster.Insecure
+		ca, err := kubeData(x.Cluster.CAData, x.Cluster.CA)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %q: %v", cluster, err)
+		}
+		if ca != nil {
+			conf.RootCAs = x509.NewCertPool()
+			conf.RootCAs.AppendCertsFromPEM(ca)
+		}
+	}
+	if c.server == "" {
+		return nil, fmt.Errorf("cluster %q not found", cluster)
+	}
+	for _, x := range kc.Users {
+		if x.Name != user {
+			continue
+		}
+		u := x.User
+		if u.ExecConfig != nil {
+			return nil, fmt.Errorf("user %q: exec credential plugins are not supported", user)
+		}
+		c.token = u.Token
+		if u.TokenFile != "" {
+			t, err := os.ReadFile(u.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("user %q: %v", user, err)
+			}
+			c.token = strings.TrimSpace(string(t))
+		}
+		crt, err := kubeData(u.CertData, u.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %v", user, err)
+		}
+		key, err := kubeData(u.KeyData, u.Key)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %v", user, err)
+		}
+		if crt != nil {
+			pair, err := tls.X509KeyPair(crt, key)
+			if err != nil {
+				return nil, fmt.Errorf("user %q: %v", user, err)
+			}
+			conf.Certificates = []tls.Certificate{pair}
+		}
+	}
+	c.http = &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+	return c, nil
+}
+
+func (c *kubeClient) get(path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	AddressType string `json:"addressType"`
+	Ports       []struct {
+		Name     string `json:"name"`
+		Port     int    `json:"port"`
+		Protocol string `json:"protocol"`
+	} `json:"ports"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+}
+
+// servers returns the ready endpoints of the slice on the named port, or
+// the first TCP port when name is empty.
+func (s *endpointSlice) servers(port string) []PoolServer {
+	n := 0
+	for _, p := range s.Ports {
+		if (port == "" && (p.Protocol == "" || p.Protocol == "TCP")) || p.Name == port {
+			n = p.Port
+			break
+		}
+	}
+	if n == 0 || (s.AddressType != "IPv4" && s.AddressType != "IPv6") {
+		return nil
+	}
+	var list []PoolServer
+	for _, e := range s.Endpoints {
+		if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+			continue
+		}
+		for _, a := range e.Addresses {
+			list = append(list, PoolServer{Address: net.JoinHostPort(a, strconv.Itoa(n)), Weight: 1})
+		}
+	}
+	return list
+}
+
+// watchKubernetes keeps the pool in sync with the EndpointSlices of its
+// Service: it lists them, then follows the watch stream until it breaks.
+func (cfg *Config) watchKubernetes(p *Pool) {
+	c := cfg.Kubernetes.client
+	ns := p.KubeNamespace
+	if ns == "" {
+		ns = c.namespace
+	}
+	if ns == "" {
+		ns = "default"
+	}
+	base := "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(ns) + "/endpointslices?labelSelector=" +
+		url.QueryEscape("kubernetes.io/service-name="+p.KubeService)
+	for {
+		if err := cfg.syncKubernetes(p, c, base); err != nil {
+			log.Printf("pool %s: kubernetes: %v", p.Name, err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+func (cfg *Config) syncKubernetes(p *Pool, c *kubeClient, base string) error {
+	resp, err := c.get(base)
+	if err != nil {
+		return err
+	}
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []endpointSlice `json:"items"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	bySlice := map[string][]PoolServer{}
+	for i := range list.Items {
+		bySlice[list.Items[i].Metadata.Name] = list.Items[i].servers(p.KubePort)
+	}
+	cfg.updatePool(p, flattenSlices(bySlice), "kubernetes")
+
+	resp, err = c.get(base + "&watch=1&allowWatchBookmarks=true&resourceVersion=" + url.QueryEscape(list.Metadata.ResourceVersion))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var ev struct {
+			Type   string        `json:"type"`
+			Object endpointSlice `json:"object"`
+		}
+		if err := dec.Decode(&ev); err == io.EOF {
+			// the API server ends watches after a timeout
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("watch: %v", err)
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			bySlice[ev.Object.Metadata.Name] = ev.Object.servers(p.KubePort)
+		case "DELETED":
+			delete(bySlice, ev.Object.Metadata.Name)
+		case "ERROR":
+			// usually 410 Gone: the resource version expired, list again
+			return nil
+		default:
+			continue
+		}
+		cfg.updatePool(p, flattenSlices(bySlice), "kubernetes")
+	}
+}
+
+// flattenSlices merges slices into one sorted, de-duplicated member list so
+// that updatePool sees no change when only the slice layout moved.
+func flattenSlices(slices map[string][]PoolServer) []PoolServer {
+	seen := map[string]bool{}
+	var list []PoolServer
+	for _, s := range slices {
+		for _, m := range s {
+			if !seen[m.Address] {
+				seen[m.Address] = true
+				list = append(list, m)
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+	return list
+}
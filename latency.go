@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const latencySamples = 512
+
+// latencyRing keeps the most recent ping round-trip times of one backend.
+type latencyRing struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+var latencies sync.Map
+
+func recordLatency(addr string, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	v, _ := latencies.LoadOrStore(addr, &latencyRing{})
+	r := v.(*latencyRing)
+	r.mu.Lock()
+	if len(r.samples) < latencySamples {
+		r.samples = append(r.samples, d)
+	} else {
+		r.samples[r.next] = d
+		r.next = (r.next + 1) % latencySamples
+	}
+	r.mu.Unlock()
+}
+
+func (r *latencyRing) percentiles(ps ...float64) ([]time.Duration, int) {
+	r.mu.Lock()
+	s := slices.Clone(r.samples)
+	r.mu.Unlock()
+	if len(s) == 0 {
+		return nil, 0
+	}
+	slices.Sort(s)
+	out := make([]time.Duration, len(ps))
+	for i, p := range ps {
+		out[i] = s[int(p*float64(len(s)-1))]
+	}
+	return out, len(s)
+}
+
+// latencyReport formats p50/p90/p99 of the ping round-trip per backend.
+func latencyReport() []string {
+	var lines []string
+	latencies.Range(func(k, v any) bool {
+		p, n := v.(*latencyRing).percentiles(0.5, 0.9, 0.99)
+		if n > 0 {
+			lines = append(lines, fmt.Sprintf("%s p50=%v p90=%v p99=%v n=%d",
+				k, p[0].Round(time.Microsecond), p[1].Round(time.Microsecond), p[2].Round(time.Microsecond), n))
+		}
+		return true
+	})
+	sort.Strings(lines)
+	return lines
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+type LegacyPing struct {
+	Mode     string `toml:"mode"`
+	MOTD     string `toml:"motd"`
+	Version  string `toml:"version"`
+	Protocol int    `toml:"protocol"`
+	Online   int    `toml:"online"`
+	Max      int    `toml:"max"`
+}
+
+func isLegacyPing(br *bufio.Reader) bool {
+	b, err := br.Peek(1)
+	return err == nil && b[0] == 0xfe
+}
+
+// pong builds the 0xFF kick packet pre-1.7 clients expect in reply to
+// a server list ping. Clients from 1.4 on send 0xFE 0x01 and understand the
+// §1 format; older ones only get motd§online§max.
+func (l *LegacyPing) pong(br *bufio.Reader) []byte {
+	var s string
+	if b, _ := br.Peek(br.Buffered()); len(b) >= 2 && b[1] == 0x01 {
+		s = strings.Join([]string{"§1", strconv.Itoa(l.Protocol), l.Version, l.MOTD,
+			strconv.Itoa(l.Online), strconv.Itoa(l.Max)}, "\x00")
+	} else {
+		s = strings.Join([]string{strings.ReplaceAll(l.MOTD, "§", ""),
+			strconv.Itoa(l.Online), strconv.Itoa(l.Max)}, "§")
+	}
+	u := utf16.Encode([]rune(s))
+	out := []byte{0xff}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(u)))
+	for _, c := range u {
+		out = binary.BigEndian.AppendUint16(out, c)
+	}
+	return out
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Listener is one address players connect to and where its traffic goes.
+// Options left empty are taken from [listen]; without any [[listener]] the
+// [listen] tcp and udp addresses become one listener each.
+type Listener struct {
+	Name     string   `toml:"name"`
+	Address  string   `toml:"address"`
+	Protocol string   `toml:"protocol"`
+	Backend  string   `toml:"backend"`
+	Pool     string   `toml:"pool"`
+	Backends []string `toml:"backends"`
+
+	UDPFallback string `toml:"udp_fallback"`
+	UDPProbe    string `toml:"udp_probe"`
+
+	AcceptProxy    bool     `toml:"accept_proxy"`
+	TrustedProxies []string `toml:"trusted_proxies"`
+	Protocols      []string `toml:"protocols"`
+	ProtocolKick   string   `toml:"protocol_kick_message"`
+	Mode           string   `toml:"mode"`
+	LoginKick      string   `toml:"login_kick_message"`
+	MaxConnections int      `toml:"max_connections"`
+	FullMessage    string   `toml:"full_message"`
+	FirstByteMs    int      `toml:"first_byte_timeout_ms"`
+	HelloTimeoutMs int      `toml:"hello_timeout_ms"`
+	HelloMinRate   int      `toml:"hello_min_rate"`
+	Validate       string   `toml:"validate"`
+	DatagramSize   int      `toml:"datagram_size"`
+	UDPSweepSecs   int      `toml:"udp_sweep_seconds"`
+	UDPLifetime    int      `toml:"udp_max_lifetime_seconds"`
+	UDPWorkers     int      `toml:"udp_workers"`
+	UDPQueue       int      `toml:"udp_queue"`
+
+	IdleTimeoutSeconds int      `toml:"idle_timeout_seconds"`
+	SendProxy          string   `toml:"send_proxy"`
+	SendProxyUDP       string   `toml:"send_proxy_udp"`
+	Limits             *Limits  `toml:"limits"`
+	Socket             *Socket  `toml:"socket"`
+	Quiet              bool     `toml:"quiet"`
+	SocketMode         string   `toml:"socket_mode"`
+	ReusePort          int      `toml:"reuse_port"`
+	FastOpen           bool     `toml:"fast_open"`
+	Multipath          *bool    `toml:"multipath"`
+	Family             string   `toml:"family"`
+	AllowCountries     []string `toml:"allow_countries"`
+	DenyCountries      []string `toml:"deny_countries"`
+	DenyASNs           []uint32 `toml:"deny_asns"`
+
+	trusted   []netip.Prefix
+	protocols []protoRange
+	pool      *Pool
+	cfg       *Config
+	unix      string
+	mode      os.FileMode
+	lns       []net.Listener
+	pcs       []net.PacketConn
+	conns     int64
+}
+
+func (cfg *Config) defaultListeners() []Listener {
+	return []Listener{
+		{Name: "tcp", Address: cfg.Listen.TCP, Protocol: "tcp"},
+		{Name: "udp", Address: cfg.Listen.UDP, Protocol: "udp"},
+	}
+}
+
+func (l *Listener) init(cfg *Config) error {
+	if l.Address == "" {
+		return fmt.Errorf("listener: address is required")
+	}
+	if l.Name == "" {
+		l.Name = l.Address
+	}
+	if path, ok := strings.CutPrefix(l.Address, "unix:"); ok {
+		l.unix = path
+	}
+	if l.unix != "" && l.Protocol != "tcp" {
+		return fmt.Errorf("listener %s: unix sockets are only supported for tcp", l.Name)
+	}
+	if l.unix != "" && l.Family != "" {
+		return fmt.Errorf("listener %s: family is for IP addresses", l.Name)
+	}
+	if l.Family == "" && l.unix == "" {
+		l.Family = cfg.Listen.Family
+	}
+	if l.unix == "" {
+		if err := l.checkFamily(); err != nil {
+			return fmt.Errorf("listener %s: %v", l.Name, err)
+		}
+	}
+	if l.SocketMode != "" {
+		m, err := strconv.ParseUint(l.SocketMode, 8, 32)
+		if err != nil || l.unix == "" {
+			return fmt.Errorf("listener %s: socket_mode must be an octal mode on a unix listener", l.Name)
+		}
+		l.mode = os.FileMode(m)
+	}
+	switch {
+	case l.ReusePort < 0:
+		return fmt.Errorf("listener %s: negative reuse_port", l.Name)
+	case l.ReusePort > 1 && (!reusePortSupported || l.unix != ""):
+		return fmt.Errorf("listener %s: reuse_port needs linux and an IP address", l.Name)
+	}
+	l.FastOpen = l.FastOpen || cfg.Listen.FastOpen
+	if l.Multipath == nil {
+		l.Multipath = cfg.Listen.Multipath
+	}
+	if l.FastOpen && (!fastOpenSupported || l.unix != "") && l.Protocol == "tcp" {
+		return fmt.Errorf("listener %s: fast_open needs linux and an IP address", l.Name)
+	}
+	switch l.Protocol {
+	case "tcp":
+		if len(l.Backends) > 0 {
+			return fmt.Errorf("listener %s: backends is for udp listeners, use a pool", l.Name)
+		}
+	case "udp":
+		if l.Pool != "" {
+			return fmt.Errorf("listener %s: pools are for tcp listeners, use backends", l.Name)
+		}
+		if l.Backend != "" {
+			l.Backends = append([]string{l.Backend}, l.Backends...)
+		}
+		if len(l.Backends) == 0 {
+			l.Backends = cfg.Backend.UDPServers
+		}
+		if l.UDPFallback == "" {
+			l.UDPFallback = cfg.Backend.UDPFallback
+		}
+		if l.UDPProbe == "" {
+			l.UDPProbe = cfg.Backend.UDPProbe
+		}
+		if !validUDPProbe(l.UDPProbe) {
+			return fmt.Errorf("listener %s: unknown udp_probe %q", l.Name, l.UDPProbe)
+		}
+	default:
+		return fmt.Errorf("listener %s: unknown protocol %q", l.Name, l.Protocol)
+	}
+
+	l.AcceptProxy = l.AcceptProxy || cfg.Listen.AcceptProxy
+	if l.TrustedProxies == nil {
+		l.TrustedProxies = cfg.Listen.TrustedProxies
+	}
+	if l.Protocols == nil {
+		l.Protocols = cfg.Listen.Protocols
+	}
+	if l.AllowCountries == nil {
+		l.AllowCountries = cfg.Listen.AllowCountries
+	}
+	if l.DenyCountries == nil {
+		l.DenyCountries = cfg.Listen.DenyCountries
+	}
+	if (len(l.AllowCountries) > 0 || len(l.DenyCountries) > 0) && cfg.GeoIP.Database == "" {
+		return fmt.Errorf("listener %s: allow_countries and deny_countries need [geoip] database", l.Name)
+	}
+	l.AllowCountries, l.DenyCountries = upperAll(l.AllowCountries), upperAll(l.DenyCountries)
+	if l.DenyASNs == nil {
+		l.DenyASNs = cfg.Listen.DenyASNs
+	}
+	if len(l.DenyASNs) > 0 && cfg.GeoIP.ASNDatabase == "" {
+		return fmt.Errorf("listener %s: deny_asns needs [geoip] asn_database", l.Name)
+	}
+	if l.ProtocolKick == "" {
+		l.ProtocolKick = cfg.Listen.ProtocolKick
+	}
+	if l.Mode == "" {
+		l.Mode = cfg.Listen.Mode
+	}
+	if l.LoginKick == "" {
+		l.LoginKick = cfg.Listen.LoginKick
+	}
+	if l.MaxConnections == 0 {
+		l.MaxConnections = cfg.Listen.MaxConnections
+	}
+	if l.FullMessage == "" {
+		l.FullMessage = cfg.Listen.FullMessage
+	}
+	if l.MaxConnections < 0 {
+		return fmt.Errorf("listener %s: negative max_connections", l.Name)
+	}
+	if l.DatagramSize == 0 {
+		l.DatagramSize = cfg.Listen.DatagramSize
+	}
+	if l.DatagramSize < minDatagramSize || l.DatagramSize > maxDatagramSize {
+		return fmt.Errorf("listener %s: datagram_size must be between %d and %d", l.Name, minDatagramSize, maxDatagramSize)
+	}
+	if l.UDPSweepSecs == 0 {
+		l.UDPSweepSecs = cfg.Listen.UDPSweepSecs
+	}
+	if l.UDPLifetime == 0 {
+		l.UDPLifetime = cfg.Listen.UDPLifetime
+	}
+	if l.UDPSweepSecs < 1 || l.UDPLifetime < 0 {
+		return fmt.Errorf("listener %s: udp_sweep_seconds must be positive and udp_max_lifetime_seconds not negative", l.Name)
+	}
+	if l.UDPWorkers == 0 {
+		l.UDPWorkers = cfg.Listen.UDPWorkers
+	}
+	if l.UDPWorkers == 0 {
+		l.UDPWorkers = runtime.GOMAXPROCS(0)
+	}
+	if l.UDPQueue == 0 {
+		l.UDPQueue = cfg.Listen.UDPQueue
+	}
+	if l.UDPWorkers < 0 || l.UDPQueue < 1 {
+		return fmt.Errorf("listener %s: udp_workers must not be negative and udp_queue must be positive", l.Name)
+	}
+	if l.FirstByteMs == 0 {
+		l.FirstByteMs = cfg.Listen.FirstByteMs
+	}
+	if l.FirstByteMs < 0 {
+		return fmt.Errorf("listener %s: negative first_byte_timeout_ms", l.Name)
+	}
+	if l.HelloTimeoutMs == 0 {
+		l.HelloTimeoutMs = cfg.Listen.HelloTimeoutMs
+	}
+	if l.HelloMinRate == 0 {
+		l.HelloMinRate = cfg.Listen.HelloMinRate
+	}
+	if l.HelloTimeoutMs < 0 || l.HelloMinRate < 0 {
+		return fmt.Errorf("listener %s: negative hello_timeout_ms or hello_min_rate", l.Name)
+	}
+	if l.Validate == "" {
+		l.Validate = cfg.Listen.Validate
+	}
+	switch l.Validate {
+	case "off", "handshake", "request":
+	default:
+		return fmt.Errorf("listener %s: unknown validate %q", l.Name, l.Validate)
+	}
+	switch l.Mode {
+	case "proxy", "status":
+	default:
+		return fmt.Errorf("listener %s: unknown mode %q", l.Name, l.Mode)
+	}
+	var err error
+	if l.protocols, err = parseProtoRanges(l.Protocols); err != nil {
+		return fmt.Errorf("listener %s: protocols: %v", l.Name, err)
+	}
+	for _, c := range l.TrustedProxies {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return fmt.Errorf("listener %s: trusted_proxies: %v", l.Name, err)
+		}
+		l.trusted = append(l.trusted, p.Masked())
+	}
+	return nil
+}
+
+// override gives the listener its own view of the config with its
+// overrides applied; pools, backends and their state stay shared.
+func (l *Listener) override(base *Config) error {
+	c := *base
+	if l.IdleTimeoutSeconds < 0 {
+		return fmt.Errorf("listener %s: negative idle_timeout_seconds", l.Name)
+	}
+	if l.IdleTimeoutSeconds != 0 {
+		c.IdleTimeoutSeconds = l.IdleTimeoutSeconds
+	}
+	if l.SendProxy != "" {
+		c.Backend.SendProxy = l.SendProxy
+	}
+	if l.SendProxyUDP != "" {
+		c.Backend.SendProxyUDP = l.SendProxyUDP
+	}
+	if l.Limits != nil {
+		if l.Limits.LoginsPerIP < 0 || l.Limits.LoginsPerIPSecs < 0 {
+			return fmt.Errorf("listener %s: limits: negative logins_per_ip or logins_per_ip_seconds", l.Name)
+		}
+		l.Limits.merge(base.Limits)
+		l.Limits.init()
+		c.Limits = *l.Limits
+	}
+	if l.Protocol == "udp" {
+		if err := c.Limits.checkUDP(l.DatagramSize); err != nil {
+			return fmt.Errorf("listener %s: limits: %v", l.Name, err)
+		}
+	}
+	if l.Socket != nil {
+		if !l.Socket.valid() {
+			return fmt.Errorf("listener %s: negative socket buffer size or dscp out of 0-63", l.Name)
+		}
+		l.Socket.merge(base.Listen.Socket)
+		c.Listen.Socket = *l.Socket
+	}
+	c.quiet = l.Quiet
+	switch {
+	case c.Backend.SendProxy != "off" && c.Backend.SendProxy != "v1" && c.Backend.SendProxy != "v2":
+		return fmt.Errorf("listener %s: unknown send_proxy mode %q", l.Name, c.Backend.SendProxy)
+	case c.Backend.SendProxyUDP != "off" && c.Backend.SendProxyUDP != "v2":
+		return fmt.Errorf("listener %s: unknown send_proxy_udp mode %q", l.Name, c.Backend.SendProxyUDP)
+	}
+	l.cfg = &c
+	return nil
+}
+
+// checkFamily validates the address against family: "dual" (the default)
+// accepts IPv4 and IPv6 on a wildcard address, "ipv4" and "ipv6" only the
+// one, the latter with IPV6_V6ONLY set.
+func (l *Listener) checkFamily() error {
+	host, err := splitHostPort(l.Address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	switch l.Family {
+	case "dual":
+	case "ipv4":
+		if err == nil && !ip.Is4() {
+			return fmt.Errorf("family ipv4 with IPv6 address %s", host)
+		}
+	case "ipv6":
+		if err == nil && ip.Is4() {
+			return fmt.Errorf("family ipv6 with IPv4 address %s", host)
+		}
+	default:
+		return fmt.Errorf("unknown family %q", l.Family)
+	}
+	return nil
+}
+
+// network is the listener's protocol narrowed to its family, as net.Listen
+// takes it: "tcp6" opens a v6-only socket, "tcp" a dual-stack one.
+func (l *Listener) network() string {
+	switch l.Family {
+	case "ipv4":
+		return l.Protocol + "4"
+	case "ipv6":
+		return l.Protocol + "6"
+	}
+	return l.Protocol
+}
+
+// listenConfig opens reuse_port sockets with SO_REUSEPORT and TCP ones
+// with Fast Open and Multipath TCP when enabled.
+func (l *Listener) listenConfig(network string) (lc net.ListenConfig, n int) {
+	var controls []controlFunc
+	n = 1
+	if l.ReusePort > 1 {
+		controls, n = append(controls, reusePortControl), l.ReusePort
+	}
+	if l.FastOpen && network == "tcp" {
+		controls = append(controls, fastOpenListenControl)
+	}
+	// unset keeps Go's default, which accepts MPTCP where the kernel has it
+	if l.Multipath != nil && network == "tcp" {
+		lc.SetMultipathTCP(*l.Multipath)
+	}
+	lc.Control = chainControl(controls)
+	return lc, n
+}
+
+type controlFunc = func(network, address string, c syscall.RawConn) error
+
+// chainControl runs several socket Control functions in order; nil for none.
+func chainControl(controls []controlFunc) controlFunc {
+	switch len(controls) {
+	case 0:
+		return nil
+	case 1:
+		return controls[0]
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, f := range controls {
+			if err := f(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// listen opens the TCP sockets of the listener, or a unix one for
+// "unix:/path" addresses. A socket file left behind by a previous run is
+// replaced.
+func (l *Listener) listen() ([]net.Listener, error) {
+	if l.unix == "" {
+		lc, n := l.listenConfig("tcp")
+		var lns []net.Listener
+		for range n {
+			ln, err := lc.Listen(context.Background(), l.network(), l.Address)
+			if err != nil {
+				return nil, err
+			}
+			lns = append(lns, ln)
+		}
+		return lns, nil
+	}
+	if fi, err := os.Lstat(l.unix); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(l.unix)
+	}
+	ln, err := net.Listen("unix", l.unix)
+	if err != nil {
+		return nil, err
+	}
+	if l.mode != 0 {
+		if err := os.Chmod(l.unix, l.mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return []net.Listener{ln}, nil
+}
+
+func (l *Listener) listenPacket() ([]net.PacketConn, error) {
+	lc, n := l.listenConfig("udp")
+	var pcs []net.PacketConn
+	for range n {
+		pc, err := lc.ListenPacket(context.Background(), l.network(), l.Address)
+		if err != nil {
+			return nil, err
+		}
+		pcs = append(pcs, pc)
+	}
+	return pcs, nil
+}
+
+// trusts reports whether a PROXY header from the peer is believed. On a
+// unix socket any peer is: who may connect is up to the file's permissions.
+func (l *Listener) trusts(a net.Addr) bool {
+	return l.AcceptProxy && (l.unix != "" || trustedSource(a, l.trusted))
+}
+
+// take reserves a place for a TCP connection or UDP association; false
+// when the listener is at max_connections.
+func (l *Listener) take() bool {
+	if n := atomic.AddInt64(&l.conns, 1); l.MaxConnections > 0 && n > int64(l.MaxConnections) {
+		atomic.AddInt64(&l.conns, -1)
+		return false
+	}
+	return true
+}
+
+func (l *Listener) release() {
+	atomic.AddInt64(&l.conns, -1)
+}
+
+// refuseFull answers a connection over max_connections: with full_message
+// set, a login is disconnected with it and a ping shows it as the MOTD;
+// otherwise the connection is just closed.
+func (cfg *Config) refuseFull(l *Listener, client net.Conn, br *bufio.Reader, cliAddr net.Addr) {
+	atomic.AddInt64(&fullRejected, 1)
+	if l.FullMessage == "" {
+		return
+	}
+	client.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	h, err := readHello(br)
+	switch {
+	case err != nil || h.legacy:
+	case h.hs.NextState == stateLogin:
+		cfg.logf("%s: login %q refused: listener %s is full", cliAddr, h.login.Name, l.Name)
+		client.Write(loginDisconnect(l.FullMessage))
+	default:
+		serveStatus(client, br, cfg.syntheticStatus(l.FullMessage, "Full"))
+	}
+}
+
+// awaitFirstByte waits up to first_byte_timeout_ms for the client to send
+// anything; false for connections that stay silent, such as port scans.
+func (l *Listener) awaitFirstByte(client net.Conn, br *bufio.Reader) bool {
+	if l.FirstByteMs == 0 {
+		return true
+	}
+	client.SetReadDeadline(time.Now().Add(time.Duration(l.FirstByteMs) * time.Millisecond))
+	_, err := br.Peek(1)
+	client.SetReadDeadline(time.Time{})
+	return err == nil
+}
+
+// logf logs a per-connection event unless the listener is quiet.
+func (cfg *Config) logf(format string, args ...any) {
+	if !cfg.quiet {
+		log.Printf(format, args...)
+	}
+}
+
+// udpBackend picks the UDP backend for a client by hashing its IP, so a
+// Bedrock player whose association expired or whose NAT port changed still
+// comes back to the server holding its session. Backends marked down by
+// health probes or the circuit breaker are skipped; with all of them down
+// the player goes to udp_fallback, if set.
+func (l *Listener) udpBackend(cliAddr net.Addr) string {
+	list := slices.DeleteFunc(slices.Clone(l.Backends), func(b string) bool {
+		return !backendHealthy(udpStateKey(b))
+	})
+	if len(list) == 0 {
+		if l.UDPFallback != "" {
+			return l.UDPFallback
+		}
+		list = l.Backends
+	}
+	if len(list) == 1 {
+		return list[0]
+	}
+	ip := sourceIP(cliAddr).AsSlice()
+	best, bs := list[0], -1.0
+	for _, b := range list {
+		if s := hrwScore(ip, b, 1); s > bs {
+			best, bs = b, s
+		}
+	}
+	return best
+}
+
+// target describes where the listener sends players, for the startup log.
+func (l *Listener) target() string {
+	if l.pool != nil {
+		return l.pool.Name
+	}
+	return strings.Join(l.Backends, ",")
+}
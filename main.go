@@ -2,13 +2,16 @@ package main
 
 import (
 	"bufio"
-	"fmt"
-	"io"
+	"bytes"
+	"errors"
 	"log"
 	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 
@@ -17,30 +20,224 @@ import (
 
 var version = "1.0.0"
 
+// handshakeTimeout bounds the opening packets on both sides of a
+// connection; set from backend.handshake_timeout_ms.
+var handshakeTimeout = 5 * time.Second
+
 type Config struct {
 	Listen struct {
-		TCP string `toml:"tcp"`
-		UDP string `toml:"udp"`
+		TCP            string    `toml:"tcp"`
+		UDP            string    `toml:"udp"`
+		AcceptProxy    bool      `toml:"accept_proxy"`
+		TrustedProxies []string  `toml:"trusted_proxies"`
+		Protocols      []string  `toml:"protocols"`
+		ProtocolKick   string    `toml:"protocol_kick_message"`
+		Mode           string    `toml:"mode"`
+		LoginKick      string    `toml:"login_kick_message"`
+		MaxConnections int       `toml:"max_connections"`
+		FullMessage    string    `toml:"full_message"`
+		FirstByteMs    int       `toml:"first_byte_timeout_ms"`
+		HelloTimeoutMs int       `toml:"hello_timeout_ms"`
+		HelloMinRate   int       `toml:"hello_min_rate"`
+		Validate       string    `toml:"validate"`
+		DatagramSize   int       `toml:"datagram_size"`
+		UDPSweepSecs   int       `toml:"udp_sweep_seconds"`
+		UDPLifetime    int       `toml:"udp_max_lifetime_seconds"`
+		UDPWorkers     int       `toml:"udp_workers"`
+		UDPQueue       int       `toml:"udp_queue"`
+		KeepAlive      KeepAlive `toml:"keepalive"`
+		Socket         Socket    `toml:"socket"`
+		FastOpen       bool      `toml:"fast_open"`
+		Multipath      *bool     `toml:"multipath"`
+		Family         string    `toml:"family"`
+		AllowCountries []string  `toml:"allow_countries"`
+		DenyCountries  []string  `toml:"deny_countries"`
+		DenyASNs       []uint32  `toml:"deny_asns"`
 	} `toml:"listen"`
-	Backend struct {
-		TCP string `toml:"tcp"`
-		UDP string `toml:"udp"`
+	Listeners []Listener `toml:"listener"`
+	Backend   struct {
+		TCP          string     `toml:"tcp"`
+		Pool         string     `toml:"pool"`
+		UDP          string     `toml:"udp"`
+		UDPServers   []string   `toml:"udp_servers"`
+		UDPFallback  string     `toml:"udp_fallback"`
+		UDPProbe     string     `toml:"udp_probe"`
+		SendProxy    string     `toml:"send_proxy"`
+		SendProxyUDP string     `toml:"send_proxy_udp"`
+		ProxyTLVs    []ProxyTLV `toml:"proxy_tlv"`
+		Forwarding   string     `toml:"forwarding"`
+		Secret       string     `toml:"forwarding_secret"`
+		SecretFile   string     `toml:"forwarding_secret_file"`
+		Transparent  bool       `toml:"transparent"`
+		Unreachable  string     `toml:"unreachable_message"`
+		RetrySecs    int        `toml:"unreachable_retry_seconds"`
+		DialRetries  int        `toml:"dial_retries"`
+		DialBudgetMs int        `toml:"dial_budget_ms"`
+		DialTimeout  int        `toml:"dial_timeout_ms"`
+		HandshakeMs  int        `toml:"handshake_timeout_ms"`
+		ResolveSecs  int        `toml:"resolve_interval_seconds"`
+		Upstream     string     `toml:"upstream_proxy"`
+		TLS          BackendTLS `toml:"tls"`
+		Mirror       string     `toml:"mirror"`
+		Fallback     string     `toml:"fallback"`
+		KeepAlive    KeepAlive  `toml:"keepalive"`
+		Socket       Socket     `toml:"socket"`
+		BindAddress  string     `toml:"bind_address"`
+		PreferFamily string     `toml:"prefer_family"`
+		EyeballsMs   int        `toml:"happy_eyeballs_delay_ms"`
+		FastOpen     bool       `toml:"fast_open"`
+		Multipath    bool       `toml:"multipath"`
+		UDPPorts     string     `toml:"udp_source_ports"`
+
+		secret   []byte
+		upstream *url.URL
+		bind     net.IP
+		udpPorts [2]int
 	} `toml:"backend"`
-	IdleTimeoutSeconds int `toml:"idle_timeout_seconds"`
+	IdleTimeoutSeconds int            `toml:"idle_timeout_seconds"`
+	Pools              []Pool         `toml:"pool"`
+	VHosts             []VHost        `toml:"vhost"`
+	Rules              []Rule         `toml:"rule"`
+	Routing            Routing        `toml:"routing"`
+	LegacyPing         LegacyPing     `toml:"legacy_ping"`
+	Status             StatusConfig   `toml:"status"`
+	Maintenance        Maintenance    `toml:"maintenance"`
+	GeoIP              GeoIP          `toml:"geoip"`
+	Bedrock            Bedrock        `toml:"bedrock"`
+	Health             HealthCheck    `toml:"health"`
+	Query              Query          `toml:"query"`
+	Circuit            CircuitBreaker `toml:"circuit_breaker"`
+	Metrics            Metrics        `toml:"metrics"`
+	Honeypot           Honeypot       `toml:"honeypot"`
+	Consul             Consul         `toml:"consul"`
+	Kubernetes         Kubernetes     `toml:"kubernetes"`
+	Affinity           Affinity       `toml:"affinity"`
+	Upgrade            Upgrade        `toml:"upgrade"`
+	Limits             Limits         `toml:"limits"`
+	Access             Access         `toml:"access"`
+	Reputation         Reputation     `toml:"reputation"`
+	Usernames          Usernames      `toml:"usernames"`
+	SecurityLog        SecurityLog    `toml:"security_log"`
+	Firewall           Firewall       `toml:"firewall"`
+	CrowdSec           CrowdSec       `toml:"crowdsec"`
+	Framing            Framing        `toml:"framing"`
+
+	pools       map[string]*Pool
+	defaultPool *Pool
+	fallback    *Pool
+	quiet       bool
 }
 
 var (
-	activeTCP int64
-	activeUDP int64
+	activeTCP  int64
+	activeUDP  int64
+	tarpitHeld int64
+
+	bedrockPlayers int64
+
+	udpPacketsUp, udpBytesUp     int64
+	udpPacketsDown, udpBytesDown int64
+
+	statusPings    int64
+	loginAttempts  int64
+	statusLimited  int64
+	loginLimited   int64
+	loginIPLimited int64
+	scannerHits    int64
+
+	protocolRejected  int64
+	fullRejected      int64
+	acceptLimited     int64
+	silentDropped     int64
+	slowDropped       int64
+	invalidDropped    int64
+	framingDropped    int64
+	accessDenied      int64
+	geoDenied         int64
+	asnDenied         int64
+	reputationFlagged int64
+	ruleDenied        int64
+	nameDenied        int64
+	udpIPLimited      int64
+	subnetLimited     int64
+	udpGlobalLimited  int64
+	cookieRejected    int64
+	udpRateLimited    int64
+	udpQueueDropped   int64
+	udpMalformed      int64
+	firewallBans      int64
+	crowdsecDenied    int64
+	crowdsecAlerted   int64
 )
 
 func loadConfig(path string) Config {
 	cfg := Config{}
 	cfg.Listen.TCP = ":25565"
 	cfg.Listen.UDP = ":25565"
+	cfg.Listen.ProtocolKick = "Unsupported client version"
+	cfg.Listen.Mode = "proxy"
+	cfg.Listen.Validate = "off"
+	cfg.Listen.LoginKick = "This address is not accepting players right now"
+	cfg.Listen.KeepAlive.Enabled = true
+	cfg.Listen.Family = "dual"
+	cfg.Listen.DatagramSize = 2048
+	cfg.Listen.UDPSweepSecs = 60
+	cfg.Listen.UDPQueue = 1024
+	cfg.Query.CacheSeconds = 5
+	cfg.Query.GameType = "SMP"
+	cfg.Query.Map = "world"
 	cfg.Backend.TCP = "127.0.0.1:25565"
 	cfg.Backend.UDP = "127.0.0.1:25565"
+	cfg.Backend.SendProxy = "v1"
+	cfg.Backend.SendProxyUDP = "off"
+	cfg.Backend.UDPProbe = "raknet"
+	cfg.Backend.Forwarding = "none"
+	cfg.Backend.RetrySecs = 30
+	cfg.Backend.DialRetries = 2
+	cfg.Backend.DialTimeout = 5000
+	cfg.Backend.HandshakeMs = 5000
+	cfg.Backend.KeepAlive.Enabled = true
+	cfg.Backend.PreferFamily = "ipv6"
+	cfg.Backend.EyeballsMs = 250
 	cfg.IdleTimeoutSeconds = 300
+	cfg.Routing.Unknown = "default"
+	cfg.Routing.KickMessage = "Unknown server address"
+	cfg.Limits.LoginLimitMessage = "Too many login attempts, please try again in a few seconds"
+	cfg.Limits.LoginsPerIPSecs = 10
+	cfg.Limits.LoginIPMessage = "Connection throttled! Please wait before reconnecting."
+	cfg.Status.OfflineVersion = "Offline"
+	cfg.Status.FaviconMode = "replace"
+	cfg.Health.Protocol = 765
+	cfg.Health.TimeoutMs = 5000
+	cfg.Health.Mode = "status"
+	cfg.Health.Rise = 1
+	cfg.Health.Fall = 1
+	cfg.Circuit.CooldownSeconds = 30
+	cfg.Consul.Address = "http://127.0.0.1:8500"
+	cfg.Honeypot = Honeypot{Threshold: 5, WindowSeconds: 600, MOTD: "A Minecraft Server", Version: "1.20.4", Max: 20}
+	cfg.Maintenance.MOTD = "Server is under maintenance"
+	cfg.Maintenance.Version = "Maintenance"
+	cfg.Maintenance.KickMessage = "Server is under maintenance, please come back later"
+	cfg.Reputation.Action = "kick"
+	cfg.Reputation.KickMessage = "VPN and proxy connections are not allowed"
+	cfg.Reputation.CacheSeconds = 3600
+	cfg.Reputation.TimeoutMs = 1500
+	cfg.Usernames.KickMessage = "You are not allowed to join this server"
+	cfg.Access.TarpitMax = 1000
+	cfg.Firewall.Table = "inet mcproxy"
+	cfg.Firewall.Set = "banned"
+	cfg.Firewall.Set6 = "banned6"
+	cfg.Firewall.Threshold = 5
+	cfg.Firewall.WindowSeconds = 60
+	cfg.Firewall.BanSeconds = 3600
+	cfg.CrowdSec.UpdateSeconds = 10
+	cfg.CrowdSec.Scenario = "mcproxy/abuse"
+	cfg.CrowdSec.Threshold = 5
+	cfg.CrowdSec.WindowSeconds = 60
+	cfg.CrowdSec.BanDuration = "4h"
+	cfg.Framing.MaxPacket = maxFrame
+	cfg.Framing.MaxHost = 255
+	cfg.LegacyPing = LegacyPing{Mode: "forward", MOTD: "A Minecraft Server", Version: "1.20.4", Protocol: 127, Max: 20}
 
 	f, err := os.ReadFile(path)
 	if err != nil {
@@ -50,148 +247,443 @@ func loadConfig(path string) Config {
 	if err := toml.Unmarshal(f, &cfg); err != nil {
 		log.Fatalf("parse config: %v", err)
 	}
+	switch cfg.Backend.SendProxy {
+	case "off", "v1", "v2":
+	default:
+		log.Fatalf("backend.send_proxy: unknown mode %q", cfg.Backend.SendProxy)
+	}
+	switch cfg.Backend.SendProxyUDP {
+	case "off", "v2":
+	default:
+		log.Fatalf("backend.send_proxy_udp: unknown mode %q", cfg.Backend.SendProxyUDP)
+	}
+	if !validUDPProbe(cfg.Backend.UDPProbe) {
+		log.Fatalf("backend.udp_probe: unknown probe %q", cfg.Backend.UDPProbe)
+	}
+	switch cfg.Backend.Forwarding {
+	case "none", "bungeecord":
+	case "velocity":
+		cfg.Backend.secret = []byte(cfg.Backend.Secret)
+		if cfg.Backend.SecretFile != "" {
+			b, err := os.ReadFile(cfg.Backend.SecretFile)
+			if err != nil {
+				log.Fatalf("backend.forwarding_secret_file: %v", err)
+			}
+			cfg.Backend.secret = bytes.TrimSpace(b)
+		}
+		if len(cfg.Backend.secret) == 0 {
+			log.Fatalf("backend.forwarding_secret is required for velocity forwarding")
+		}
+	default:
+		log.Fatalf("backend.forwarding: unknown mode %q", cfg.Backend.Forwarding)
+	}
+	if cfg.Backend.DialTimeout < 0 || cfg.Backend.HandshakeMs < 1 {
+		log.Fatalf("backend: dial_timeout_ms must not be negative and handshake_timeout_ms must be positive")
+	}
+	handshakeTimeout = time.Duration(cfg.Backend.HandshakeMs) * time.Millisecond
+	if !cfg.Listen.KeepAlive.valid() || !cfg.Backend.KeepAlive.valid() {
+		log.Fatalf("keepalive: idle_seconds, interval_seconds and count must not be negative")
+	}
+	if !cfg.Listen.Socket.valid() || !cfg.Backend.Socket.valid() {
+		log.Fatalf("socket: send_buffer and receive_buffer must not be negative, dscp must be 0-63")
+	}
+	switch cfg.Backend.PreferFamily {
+	case "ipv6", "ipv4":
+	default:
+		log.Fatalf("backend.prefer_family: unknown family %q", cfg.Backend.PreferFamily)
+	}
+	if cfg.Backend.EyeballsMs < 0 {
+		log.Fatalf("backend.happy_eyeballs_delay_ms: must not be negative")
+	}
+	preferIPv4 = cfg.Backend.PreferFamily == "ipv4"
+	eyeballsDelay = time.Duration(cfg.Backend.EyeballsMs) * time.Millisecond
+	if len(cfg.Backend.UDPServers) == 0 {
+		cfg.Backend.UDPServers = []string{cfg.Backend.UDP}
+	}
+	if err := cfg.Backend.TLS.init(); err != nil {
+		log.Fatalf("backend.tls: %v", err)
+	}
+	if cfg.Backend.Mirror != "" && cfg.Backend.Forwarding == "velocity" {
+		log.Fatalf("backend.mirror: not supported with velocity forwarding")
+	}
+	if cfg.Backend.Upstream != "" {
+		if cfg.Backend.upstream, err = parseUpstream(cfg.Backend.Upstream); err != nil {
+			log.Fatalf("backend.upstream_proxy: %v", err)
+		}
+		if cfg.Backend.Transparent {
+			log.Fatalf("backend.upstream_proxy: cannot be combined with transparent")
+		}
+	}
+	if cfg.Backend.BindAddress != "" {
+		ip, err := netip.ParseAddr(cfg.Backend.BindAddress)
+		if err != nil {
+			log.Fatalf("backend.bind_address: %v", err)
+		}
+		if cfg.Backend.Transparent {
+			log.Fatalf("backend.bind_address: cannot be combined with transparent")
+		}
+		cfg.Backend.bind = ip.AsSlice()
+	}
+	if cfg.Backend.UDPPorts != "" {
+		lo, hi, ok := strings.Cut(cfg.Backend.UDPPorts, "-")
+		if !ok {
+			hi = lo
+		}
+		a, err1 := strconv.Atoi(strings.TrimSpace(lo))
+		b, err2 := strconv.Atoi(strings.TrimSpace(hi))
+		if err1 != nil || err2 != nil || a < 1 || b > 65535 || a > b {
+			log.Fatalf("backend.udp_source_ports: want a port or a range like \"40000-40999\", got %q", cfg.Backend.UDPPorts)
+		}
+		cfg.Backend.udpPorts = [2]int{a, b}
+	}
+	if cfg.Backend.Transparent && !transparentSupported {
+		log.Fatalf("backend.transparent: only supported on linux")
+	}
+	if cfg.Backend.FastOpen && !fastOpenSupported {
+		log.Fatalf("backend.fast_open: only supported on linux")
+	}
+	for i := range cfg.Backend.ProxyTLVs {
+		if err := cfg.Backend.ProxyTLVs[i].init(); err != nil {
+			log.Fatalf("backend.proxy_tlv: %v", err)
+		}
+	}
+	if err := checkProxyTLVs(cfg.Backend.ProxyTLVs); err != nil {
+		log.Fatalf("backend.proxy_tlv: %v", err)
+	}
+	for i := range cfg.VHosts {
+		if err := cfg.VHosts[i].init(); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	for i := range cfg.Rules {
+		if err := cfg.Rules[i].init(i + 1); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if cfg.Routing.DefaultBackend == "" {
+		cfg.Routing.DefaultBackend = cfg.Backend.TCP
+	}
+	if len(cfg.Listeners) == 0 {
+		cfg.Listeners = cfg.defaultListeners()
+	}
+	for i := range cfg.Listeners {
+		if err := cfg.Listeners[i].init(&cfg); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if err := cfg.initPools(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	for _, a := range cfg.backendAddrs() {
+		if err := checkBackendAddr(a); err != nil {
+			log.Fatalf("backend: %v", err)
+		}
+	}
+	for _, l := range cfg.Listeners {
+		for _, a := range l.Backends {
+			if err := checkBackendAddr(a); err != nil {
+				log.Fatalf("listener %s: %v", l.Name, err)
+			}
+		}
+		if l.UDPFallback != "" {
+			if err := checkBackendAddr(l.UDPFallback); err != nil {
+				log.Fatalf("listener %s: udp_fallback: %v", l.Name, err)
+			}
+		}
+		// failover only moves clients off backends marked down, by a probe
+		// or by the circuit breaker
+		if l.Protocol == "udp" && l.UDPFallback != "" && cfg.Circuit.Failures <= 0 &&
+			(cfg.Health.IntervalSeconds <= 0 || l.UDPProbe == "none") {
+			log.Fatalf("listener %s: udp_fallback: needs [health] interval_seconds and a udp_probe, or circuit_breaker.failures", l.Name)
+		}
+	}
+	if _, err := cfg.udpProbes(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	for i := range cfg.Pools {
+		if cfg.Pools[i].KubeService != "" {
+			if err := cfg.Kubernetes.init(); err != nil {
+				log.Fatalf("kubernetes: %v", err)
+			}
+			break
+		}
+	}
+	if cfg.Upgrade.DrainTimeoutSeconds < 0 {
+		log.Fatalf("upgrade.drain_timeout_seconds: must not be negative")
+	}
+	if err := cfg.Affinity.init(); err != nil {
+		log.Fatalf("affinity: %v", err)
+	}
+	if cfg.Limits.LoginsPerIP < 0 || cfg.Limits.LoginsPerIPSecs <= 0 {
+		log.Fatalf("limits.logins_per_ip: must not be negative, and logins_per_ip_seconds must be positive")
+	}
+	cfg.Limits.init()
+	switch cfg.Status.FaviconMode {
+	case "replace", "fill":
+	default:
+		log.Fatalf("status.favicon_mode: unknown mode %q", cfg.Status.FaviconMode)
+	}
+	if cfg.Status.Favicon != "" {
+		if cfg.Status.favicon, err = loadFavicon(cfg.Status.Favicon); err != nil {
+			log.Fatalf("status.favicon: %v", err)
+		}
+	}
+	if cfg.GeoIP.ReloadSeconds < 0 {
+		log.Fatalf("geoip.reload_seconds: must not be negative")
+	}
+	if cfg.GeoIP.Database != "" {
+		if err := openGeoIP(&geoDB, cfg.GeoIP.Database); err != nil {
+			log.Fatalf("geoip.database: %v", err)
+		}
+		if cfg.GeoIP.ReloadSeconds > 0 {
+			go cfg.GeoIP.watch(&geoDB, cfg.GeoIP.Database)
+		}
+	}
+	if cfg.GeoIP.ASNDatabase != "" {
+		if err := openGeoIP(&asnDB, cfg.GeoIP.ASNDatabase); err != nil {
+			log.Fatalf("geoip.asn_database: %v", err)
+		}
+		if cfg.GeoIP.ReloadSeconds > 0 {
+			go cfg.GeoIP.watch(&asnDB, cfg.GeoIP.ASNDatabase)
+		}
+	}
+	if cfg.Reputation.enabled() {
+		if err := cfg.Reputation.init(); err != nil {
+			log.Fatalf("reputation: %v", err)
+		}
+	}
+	if err := cfg.Usernames.init(); err != nil {
+		log.Fatalf("usernames: %v", err)
+	}
+	if cfg.Firewall.enabled() {
+		if err := cfg.Firewall.init(); err != nil {
+			log.Fatalf("firewall: %v", err)
+		}
+	}
+	if cfg.Framing.Enabled {
+		if err := cfg.Framing.init(); err != nil {
+			log.Fatalf("framing: %v", err)
+		}
+	}
+	if cfg.CrowdSec.enabled() {
+		if err := cfg.CrowdSec.init(); err != nil {
+			log.Fatalf("crowdsec: %v", err)
+		}
+	}
+	if cfg.SecurityLog.Path != "" {
+		if err := cfg.SecurityLog.open(); err != nil {
+			log.Fatalf("security_log.path: %v", err)
+		}
+	}
+	if cfg.Access.TarpitSecs < 0 || cfg.Access.TarpitMax < 0 {
+		log.Fatalf("access: tarpit_seconds and tarpit_max must not be negative")
+	}
+	if cfg.Access.AllowFile != "" || cfg.Access.DenyFile != "" {
+		if err := cfg.Access.load(); err != nil {
+			log.Fatalf("access.%v", err)
+		}
+	}
+	if cfg.Honeypot.Enabled {
+		if cfg.Honeypot.Threshold < 1 || cfg.Honeypot.WindowSeconds < 1 {
+			log.Fatalf("honeypot: threshold and window_seconds must be positive")
+		}
+		go scanners.sweep(time.Duration(cfg.Honeypot.WindowSeconds) * time.Second)
+	}
+	cfg.Maintenance.init()
+	maintenance.Store(cfg.Maintenance.Enabled)
+	switch cfg.Health.Mode {
+	case "status", "tcp":
+	default:
+		log.Fatalf("health.mode: unknown mode %q", cfg.Health.Mode)
+	}
+	if cfg.Health.TimeoutMs < 1 || cfg.Health.Rise < 1 || cfg.Health.Fall < 1 {
+		log.Fatalf("health: timeout_ms, rise and fall must be positive")
+	}
+	switch cfg.LegacyPing.Mode {
+	case "forward", "local", "close":
+	default:
+		log.Fatalf("legacy_ping.mode: unknown mode %q", cfg.LegacyPing.Mode)
+	}
+	switch cfg.Routing.Unknown {
+	case "default", "kick", "close":
+	default:
+		log.Fatalf("routing.unknown: unknown action %q", cfg.Routing.Unknown)
+	}
+	if cfg.Query.CacheSeconds < 0 {
+		log.Fatalf("query.cache_seconds: must not be negative")
+	}
+	if cfg.Query.Enabled {
+		if cfg.Query.Backend == "" {
+			cfg.Query.Backend = cfg.Backend.TCP
+		}
+		cfg.Query.cookies = newAddrCookies()
+	}
+	for i := range cfg.Listeners {
+		if err := cfg.Listeners[i].override(&cfg); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
 	return cfg
 }
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	cfg := loadConfig("config.toml")
-	idle := time.Duration(cfg.IdleTimeoutSeconds) * time.Second
 
-	log.Printf("mcproxy %s starting; tcp=%s udp=%s backend=%s", version, cfg.Listen.TCP, cfg.Listen.UDP, cfg.Backend.TCP)
+	log.Printf("mcproxy %s starting", version)
 
-	go udpForward(cfg.Listen.UDP, cfg.Backend.UDP, idle)
+	cfg.loadActivation()
+	cfg.startDiscovery()
+	cfg.startResolver()
+	cfg.startHealthChecks()
+	cfg.startMetrics()
 
-	go console()
-
-	ln, err := net.Listen("tcp", cfg.Listen.TCP)
-	if err != nil {
-		log.Fatalf("tcp listen: %v", err)
-	}
-	for {
-		c, err := ln.Accept()
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		lns, pcs := l.claim()
+		from := ""
+		if len(lns) > 0 || len(pcs) > 0 {
+			from = " (systemd)"
+			if os.Getenv(upgradeReadyEnv) != "" {
+				from = " (upgrade)"
+			}
+		}
+		var err error
+		switch {
+		case from != "":
+		case l.Protocol == "udp":
+			pcs, err = l.listenPacket()
+		default:
+			lns, err = l.listen()
+		}
 		if err != nil {
-			log.Printf("accept: %v", err)
-			continue
+			log.Fatalf("listener %s: %v", l.Name, err)
+		}
+		l.lns, l.pcs = lns, pcs
+		for _, pc := range pcs {
+			go udpForward(l.cfg, l, pc)
+		}
+		for _, ln := range lns {
+			go serveTCP(l, ln)
 		}
-		go handleTCP(c, cfg.Backend.TCP)
+		log.Printf("listener %s: %s %s%s -> %s", l.Name, l.network(), l.Address, from, l.target())
 	}
-}
-
-func handleTCP(client net.Conn, backendAddr string) {
-	atomic.AddInt64(&activeTCP, 1)
-	defer func() {
-		client.Close()
-		atomic.AddInt64(&activeTCP, -1)
-	}()
-
-	backend, err := net.Dial("tcp", backendAddr)
-	if err != nil {
-		log.Printf("dial backend: %v", err)
-		return
+	closeUnclaimed()
+	upgradeReady()
+	if len(upgradeSignals) > 0 {
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, upgradeSignals...)
+			for range sig {
+				cfg.upgradeCommand()
+			}
+		}()
 	}
-	defer backend.Close()
-
-	cliAddr := client.RemoteAddr().(*net.TCPAddr)
-	locAddr := backend.LocalAddr().(*net.TCPAddr)
-
-	hdr := fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", cliAddr.IP.String(), locAddr.IP.String(), cliAddr.Port, locAddr.Port)
-	if _, err = io.WriteString(backend, hdr); err != nil {
-		log.Printf("write hdr: %v", err)
-		return
+	if len(reloadSignals) > 0 {
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, reloadSignals...)
+			for range sig {
+				cfg.Access.reload()
+				cfg.SecurityLog.reopen()
+			}
+		}()
 	}
-
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() { io.Copy(backend, client); backend.SetDeadline(time.Now()); wg.Done() }()
-	go func() { io.Copy(client, backend); client.SetDeadline(time.Now()); wg.Done() }()
-	wg.Wait()
+	console(&cfg)
+	select {}
 }
 
-type assoc struct {
-	cliAddr  *net.UDPAddr
-	backend  *net.UDPConn
-	lastSeen time.Time
-}
-
-func udpForward(listenAddr, backendAddr string, idle time.Duration) {
-	pc, err := net.ListenPacket("udp", listenAddr)
-	if err != nil {
-		log.Fatalf("udp listen: %v", err)
-	}
-	defer pc.Close()
-
-	backendUDP, err := net.ResolveUDPAddr("udp", backendAddr)
-	if err != nil {
-		log.Fatalf("resolve backend: %v", err)
-	}
-
-	assocs := make(map[string]*assoc)
-	var mu sync.Mutex
-
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			mu.Lock()
-			for k, v := range assocs {
-				if time.Since(v.lastSeen) > idle {
-					v.backend.Close()
-					delete(assocs, k)
-					atomic.AddInt64(&activeUDP, -1)
-				}
-			}
-			mu.Unlock()
-		}
-	}()
-
-	buf := make([]byte, 2048)
+func serveTCP(l *Listener, ln net.Listener) {
 	for {
-		n, addr, err := pc.ReadFrom(buf)
+		c, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
-			log.Printf("udp read: %v", err)
+			log.Printf("listener %s: accept: %v", l.Name, err)
 			continue
 		}
-		key := addr.String()
-
-		mu.Lock()
-		a, ok := assocs[key]
-		if !ok {
-			bc, err := net.DialUDP("udp", nil, backendUDP)
-			if err != nil {
-				mu.Unlock()
-				log.Printf("dial udp backend: %v", err)
-				continue
-			}
-			a = &assoc{cliAddr: addr.(*net.UDPAddr), backend: bc, lastSeen: time.Now()}
-			assocs[key] = a
-			atomic.AddInt64(&activeUDP, 1)
-
-			go func(ac *assoc) {
-				b := make([]byte, 2048)
-				for {
-					m, err := ac.backend.Read(b)
-					if err != nil {
-						return
-					}
-					pc.WriteTo(b[:m], ac.cliAddr)
-				}
-			}(a)
+		// over accept_rate the connection is closed before it costs a
+		// goroutine or a backend dial
+		if !l.cfg.Limits.accept.allow() {
+			atomic.AddInt64(&acceptLimited, 1)
+			c.Close()
+			continue
+		}
+		if !l.trusts(c.RemoteAddr()) && !l.sourceAllowed(sourceIP(c.RemoteAddr())) {
+			l.cfg.Access.refuse(c)
+			continue
 		}
-		a.lastSeen = time.Now()
-		_, _ = a.backend.Write(buf[:n])
-		mu.Unlock()
+		l.cfg.Listen.KeepAlive.set(c)
+		l.cfg.Listen.Socket.set(c)
+		go handleTCP(c, l.cfg, l)
 	}
 }
 
-func console() {
+func console(cfg *Config) {
 	sc := bufio.NewScanner(os.Stdin)
 	for sc.Scan() {
 		cmd := strings.TrimSpace(sc.Text())
-		switch cmd {
+		args := strings.Fields(cmd)
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
 		case "stats":
-			log.Printf("stats: tcp=%d udp=%d", atomic.LoadInt64(&activeTCP), atomic.LoadInt64(&activeUDP))
+			log.Printf("stats: tcp=%d udp=%d bedrock_players=%d tarpit=%d firewall_bans=%d crowdsec_alerts=%d", atomic.LoadInt64(&activeTCP),
+				atomic.LoadInt64(&activeUDP), atomic.LoadInt64(&bedrockPlayers), atomic.LoadInt64(&tarpitHeld), atomic.LoadInt64(&firewallBans),
+				atomic.LoadInt64(&crowdsecAlerted))
+			log.Printf("stats: status=%d (limited %d) login=%d (limited %d, per ip %d) accept limited %d",
+				atomic.LoadInt64(&statusPings), atomic.LoadInt64(&statusLimited), atomic.LoadInt64(&loginAttempts),
+				atomic.LoadInt64(&loginLimited), atomic.LoadInt64(&loginIPLimited), atomic.LoadInt64(&acceptLimited))
+			log.Printf("stats: rejected protocol=%d scanner=%d full=%d silent=%d slow=%d invalid=%d framing=%d denied=%d geo=%d asn=%d rule=%d reputation=%d subnet=%d name=%d crowdsec=%d", atomic.LoadInt64(&protocolRejected),
+				atomic.LoadInt64(&scannerHits), atomic.LoadInt64(&fullRejected), atomic.LoadInt64(&silentDropped),
+				atomic.LoadInt64(&slowDropped), atomic.LoadInt64(&invalidDropped), atomic.LoadInt64(&framingDropped), atomic.LoadInt64(&accessDenied), atomic.LoadInt64(&geoDenied), atomic.LoadInt64(&asnDenied),
+				atomic.LoadInt64(&ruleDenied), atomic.LoadInt64(&reputationFlagged), atomic.LoadInt64(&subnetLimited),
+				atomic.LoadInt64(&nameDenied), atomic.LoadInt64(&crowdsecDenied))
+			log.Printf("stats: udp limited per_ip=%d total=%d cookie=%d rate=%d queue_full=%d malformed=%d", atomic.LoadInt64(&udpIPLimited),
+				atomic.LoadInt64(&udpGlobalLimited), atomic.LoadInt64(&cookieRejected), atomic.LoadInt64(&udpRateLimited),
+				atomic.LoadInt64(&udpQueueDropped), atomic.LoadInt64(&udpMalformed))
+			log.Printf("stats: udp up packets=%d bytes=%d down packets=%d bytes=%d",
+				atomic.LoadInt64(&udpPacketsUp), atomic.LoadInt64(&udpBytesUp),
+				atomic.LoadInt64(&udpPacketsDown), atomic.LoadInt64(&udpBytesDown))
+			for _, l := range healthReport() {
+				log.Printf("stats: backend %s", l)
+			}
+			for _, l := range bedrockReport() {
+				log.Printf("stats: bedrock %s", l)
+			}
+			for _, l := range latencyReport() {
+				log.Printf("stats: latency %s", l)
+			}
+		case "maintenance":
+			if len(args) > 1 {
+				switch args[1] {
+				case "on":
+					maintenance.Store(true)
+				case "off":
+					maintenance.Store(false)
+				default:
+					log.Printf("usage: maintenance [on|off]")
+					continue
+				}
+			}
+			log.Printf("maintenance: %v", maintenance.Load())
+		case "udp":
+			udpCommand(args[1:])
+		case "canary":
+			cfg.canaryCommand(args[1:])
+		case "access":
+			if len(args) != 2 || args[1] != "reload" {
+				log.Printf("usage: access reload")
+				continue
+			}
+			cfg.Access.reload()
+		case "upgrade":
+			cfg.upgradeCommand()
 		case "quit", "exit", "stop":
 			log.Println("shutdown requested")
+			cfg.Affinity.save()
 			os.Exit(0)
 		default:
 			log.Printf("unknown cmd: %s", cmd)
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+type Maintenance struct {
+	Enabled     bool     `toml:"enabled"`
+	MOTD        string   `toml:"motd"`
+	Version     string   `toml:"version"`
+	KickMessage string   `toml:"kick_message"`
+	Bypass      []string `toml:"bypass"`
+
+	bypassNets  []netip.Prefix
+	bypassNames map[string]bool
+}
+
+// maintenance is the runtime state, seeded from the config and toggled
+// from the console.
+var maintenance atomic.Bool
+
+// init sorts bypass entries into addresses/CIDRs and usernames.
+func (m *Maintenance) init() {
+	m.bypassNames = make(map[string]bool)
+	for _, b := range m.Bypass {
+		if p, err := netip.ParsePrefix(b); err == nil {
+			m.bypassNets = append(m.bypassNets, p.Masked())
+		} else if a, err := netip.ParseAddr(b); err == nil {
+			m.bypassNets = append(m.bypassNets, netip.PrefixFrom(a, a.BitLen()))
+		} else {
+			m.bypassNames[strings.ToLower(b)] = true
+		}
+	}
+}
+
+func (m *Maintenance) bypass(h *clientHello, cliAddr net.Addr) bool {
+	if trustedSource(cliAddr, m.bypassNets) {
+		return true
+	}
+	return h.hs.NextState == stateLogin && m.bypassNames[strings.ToLower(h.login.Name)]
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	stateStatus = 1
+	stateLogin  = 2
+
+	maxHandshakeLen = 4096
+	maxLoginLen     = 1024
+)
+
+var errVarInt = errors.New("varint too long")
+
+func readVarInt(r io.ByteReader) (int32, error) {
+	var v uint32
+	for i := 0; i < 5; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint32(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			return int32(v), nil
+		}
+	}
+	return 0, errVarInt
+}
+
+func appendVarInt(b []byte, v int32) []byte {
+	u := uint32(v)
+	for u >= 0x80 {
+		b = append(b, byte(u)|0x80)
+		u >>= 7
+	}
+	return append(b, byte(u))
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendVarInt(b, int32(len(s)))
+	return append(b, s...)
+}
+
+// packetReader decodes fields of a single packet body.
+type packetReader struct {
+	b   []byte
+	err error
+}
+
+func (p *packetReader) ReadByte() (byte, error) {
+	if len(p.b) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	c := p.b[0]
+	p.b = p.b[1:]
+	return c, nil
+}
+
+func (p *packetReader) varInt() int32 {
+	if p.err != nil {
+		return 0
+	}
+	v, err := readVarInt(p)
+	p.err = err
+	return v
+}
+
+func (p *packetReader) string(max int) string {
+	n := int(p.varInt())
+	if p.err != nil {
+		return ""
+	}
+	if n < 0 || n > max*4 || n > len(p.b) {
+		p.err = fmt.Errorf("bad string length %d", n)
+		return ""
+	}
+	s := string(p.b[:n])
+	p.b = p.b[n:]
+	return s
+}
+
+func (p *packetReader) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(p.b) {
+		p.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := p.b[:n]
+	p.b = p.b[n:]
+	return b
+}
+
+func (p *packetReader) uint16() uint16 {
+	b := p.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+// readPacket reads one uncompressed length-prefixed frame and returns the
+// packet id, its body and the raw frame as it appeared on the wire.
+func readPacket(r *bufio.Reader, max int) (id int32, body, raw []byte, err error) {
+	n, err := readVarInt(r)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if n <= 0 || int(n) > max {
+		return 0, nil, nil, fmt.Errorf("bad packet length %d", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, nil, nil, err
+	}
+	p := &packetReader{b: frame}
+	id = p.varInt()
+	if p.err != nil {
+		return 0, nil, nil, p.err
+	}
+	raw = appendVarInt(make([]byte, 0, len(frame)+5), n)
+	return id, p.b, append(raw, frame...), nil
+}
+
+func framePacket(id int32, body []byte) []byte {
+	inner := appendVarInt(nil, id)
+	inner = append(inner, body...)
+	out := appendVarInt(make([]byte, 0, len(inner)+5), int32(len(inner)))
+	return append(out, inner...)
+}
+
+type handshake struct {
+	Protocol  int32
+	Host      string
+	Port      uint16
+	NextState int32
+}
+
+func parseHandshake(id int32, body []byte) (handshake, error) {
+	var h handshake
+	if id != 0x00 {
+		return h, fmt.Errorf("unexpected packet 0x%02x in handshake", id)
+	}
+	p := &packetReader{b: body}
+	h.Protocol = p.varInt()
+	h.Host = p.string(maxHandshakeLen / 4)
+	h.Port = p.uint16()
+	h.NextState = p.varInt()
+	if p.err != nil {
+		return h, fmt.Errorf("handshake: %v", p.err)
+	}
+	return h, nil
+}
+
+func (h handshake) encode() []byte {
+	b := appendVarInt(nil, h.Protocol)
+	b = appendString(b, h.Host)
+	b = binary.BigEndian.AppendUint16(b, h.Port)
+	b = appendVarInt(b, h.NextState)
+	return framePacket(0x00, b)
+}
+
+type loginStart struct {
+	Name    string
+	UUID    [16]byte
+	HasUUID bool
+
+	// malformed is set when the rest of the packet does not parse for
+	// the protocol
+	malformed bool
+}
+
+func parseLoginStart(id int32, body []byte, protocol int32) (loginStart, error) {
+	var l loginStart
+	if id != 0x00 {
+		return l, fmt.Errorf("unexpected packet 0x%02x in login", id)
+	}
+	p := &packetReader{b: body}
+	l.Name = p.string(16)
+	if p.err != nil {
+		return l, fmt.Errorf("login start: %v", p.err)
+	}
+	l.UUID, l.HasUUID = loginUUID(p, protocol)
+	l.malformed = p.err != nil || len(p.b) > 0
+	return l, nil
+}
+
+// loginUUID reads the profile UUID after the name: optional from 1.19.1
+// (760, behind the signature data that 1.19 started sending), always there
+// from 1.20.2 (764). A rest that does not parse just means no UUID.
+func loginUUID(p *packetReader, protocol int32) ([16]byte, bool) {
+	var u [16]byte
+	has := func() bool {
+		b := p.bytes(1)
+		return b != nil && b[0] != 0
+	}
+	switch {
+	case protocol < 759:
+		return u, false
+	case protocol <= 760:
+		if has() {
+			p.bytes(8)
+			p.bytes(int(p.varInt()))
+			p.bytes(int(p.varInt()))
+		}
+		if protocol == 759 || !has() {
+			return u, false
+		}
+	case protocol < 764:
+		if !has() {
+			return u, false
+		}
+	}
+	b := p.bytes(16)
+	if b == nil {
+		return u, false
+	}
+	copy(u[:], b)
+	return u, true
+}
+
+func offlineUUID(name string) [16]byte {
+	u := md5.Sum([]byte("OfflinePlayer:" + name))
+	u[6] = u[6]&0x0f | 0x30
+	u[8] = u[8]&0x3f | 0x80
+	return u
+}
+
+// clientHello is the opening of a client connection: the handshake and, for
+// login connections, the Login Start packet, with their raw frames.
+type clientHello struct {
+	legacy   bool
+	hs       handshake
+	hsRaw    []byte
+	login    loginStart
+	loginRaw []byte
+}
+
+func readHello(br *bufio.Reader) (*clientHello, error) {
+	if isLegacyPing(br) {
+		return &clientHello{legacy: true}, nil
+	}
+	id, body, raw, err := readPacket(br, maxHandshakeLen)
+	if err != nil {
+		return nil, err
+	}
+	h := &clientHello{hsRaw: raw}
+	if h.hs, err = parseHandshake(id, body); err != nil {
+		return nil, err
+	}
+	if h.hs.NextState != stateLogin {
+		return h, nil
+	}
+	id, body, h.loginRaw, err = readPacket(br, maxLoginLen)
+	if err != nil {
+		return nil, err
+	}
+	if h.login, err = parseLoginStart(id, body, h.hs.Protocol); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// awaitStatusRequest waits for the status request that follows a status
+// handshake, leaving it in br for whoever answers it.
+func awaitStatusRequest(br *bufio.Reader) error {
+	b, err := br.Peek(2)
+	if err != nil {
+		return err
+	}
+	if b[0] != 0x01 || b[1] != 0x00 {
+		return fmt.Errorf("expected status request, got % x", b)
+	}
+	return nil
+}
+
+func (h *clientHello) raw() []byte {
+	return append(append([]byte(nil), h.hsRaw...), h.loginRaw...)
+}
+
+func chatJSON(msg string) string {
+	b, _ := json.Marshal(map[string]string{"text": msg})
+	return string(b)
+}
+
+func loginDisconnect(msg string) []byte {
+	return framePacket(0x00, appendString(nil, chatJSON(msg)))
+}
+
+type protoRange struct{ lo, hi int32 }
+
+// parseProtoRanges parses entries like "765" or "763-766".
+func parseProtoRanges(list []string) ([]protoRange, error) {
+	var out []protoRange
+	for _, s := range list {
+		lo, hi, isRange := strings.Cut(s, "-")
+		a, err := strconv.ParseInt(strings.TrimSpace(lo), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("protocol %q: %v", s, err)
+		}
+		b := a
+		if isRange {
+			if b, err = strconv.ParseInt(strings.TrimSpace(hi), 10, 32); err != nil {
+				return nil, fmt.Errorf("protocol %q: %v", s, err)
+			}
+		}
+		if b < a {
+			return nil, fmt.Errorf("protocol %q: empty range", s)
+		}
+		out = append(out, protoRange{int32(a), int32(b)})
+	}
+	return out, nil
+}
+
+func protoAllowed(rs []protoRange, v int32) bool {
+	if len(rs) == 0 {
+		return true
+	}
+	for _, r := range rs {
+		if v >= r.lo && v <= r.hi {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLoginStart(t *testing.T) {
+	id := [16]byte{0: 0x12, 15: 0x34}
+	name := appendString(nil, "Steve")
+	cat := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+	// 1.19 and 1.19.1 signature data: timestamp, public key, signature
+	sig := cat([]byte{1}, make([]byte, 8), appendVarInt(nil, 3), []byte{1, 2, 3}, appendVarInt(nil, 2), []byte{4, 5})
+	tests := []struct {
+		name      string
+		protocol  int32
+		body      []byte
+		hasUUID   bool
+		malformed bool
+	}{
+		{"1.18.2 name only", 758, name, false, false},
+		{"1.18.2 trailing bytes", 758, cat(name, id[:]), false, true},
+		{"1.19 no signature", 759, cat(name, []byte{0}), false, false},
+		{"1.19 signature", 759, cat(name, sig), false, false},
+		{"1.19 missing signature flag", 759, name, false, true},
+		{"1.19 truncated signature", 759, cat(name, sig[:12]), false, true},
+		{"1.19.1 signature and uuid", 760, cat(name, sig, []byte{1}, id[:]), true, false},
+		{"1.19.1 no signature, uuid", 760, cat(name, []byte{0, 1}, id[:]), true, false},
+		{"1.19.1 signature, no uuid", 760, cat(name, sig, []byte{0}), false, false},
+		{"1.19.1 uuid flag without uuid", 760, cat(name, []byte{0, 1}), false, true},
+		{"1.19.3 uuid", 761, cat(name, []byte{1}, id[:]), true, false},
+		{"1.20.1 no uuid", 763, cat(name, []byte{0}), false, false},
+		{"1.20.1 signature data is gone", 763, cat(name, sig), false, true},
+		{"1.20.2 uuid", 764, cat(name, id[:]), true, false},
+		{"1.20.4 missing uuid", 765, name, false, true},
+		{"1.20.4 short uuid", 765, cat(name, id[:10]), false, true},
+		{"1.21 trailing bytes", 767, cat(name, id[:], []byte{0}), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := parseLoginStart(0x00, tt.body, tt.protocol)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l.Name != "Steve" || l.HasUUID != tt.hasUUID || l.malformed != tt.malformed {
+				t.Errorf("got name %q, uuid %v, malformed %v; want uuid %v, malformed %v",
+					l.Name, l.HasUUID, l.malformed, tt.hasUUID, tt.malformed)
+			}
+			if l.HasUUID && l.UUID != id {
+				t.Errorf("uuid % x, want % x", l.UUID, id)
+			}
+		})
+	}
+	if _, err := parseLoginStart(0x01, name, 765); err == nil {
+		t.Error("packet 0x01 taken for Login Start")
+	}
+	if _, err := parseLoginStart(0x00, appendString(nil, strings.Repeat("a", 65)), 765); err == nil {
+		t.Error("name over 64 bytes taken")
+	}
+}
+
+func TestOfflineUUID(t *testing.T) {
+	for name, want := range map[string]string{
+		"Notch": "b50ad385-829d-3141-a216-7e7d7539ba7f",
+		"jeb_":  "a762f560-4fce-3236-812a-b80efff0b62b",
+	} {
+		u, _ := parseUUID(want)
+		if got := offlineUUID(name); got != u {
+			t.Errorf("offlineUUID(%q) = % x, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+type Metrics struct {
+	Listen string `toml:"listen"`
+}
+
+// metricsSocketName is the name the metrics socket is passed under on an
+// upgrade, and may be given with FileDescriptorName= under systemd.
+const metricsSocketName = "metrics"
+
+var metricsListener net.Listener
+
+func (cfg *Config) startMetrics() {
+	if cfg.Metrics.Listen == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	mux.HandleFunc("/udp", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		list := udpAssocs(r.URL.Query().Get("client"))
+		if list == nil {
+			list = []udpAssocInfo{}
+		}
+		json.NewEncoder(w).Encode(list)
+	})
+	ln := takeActivated(metricsSocketName)
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", cfg.Metrics.Listen); err != nil {
+			log.Fatalf("metrics: %v", err)
+		}
+	}
+	metricsListener = ln
+	go func() {
+		err := http.Serve(ln, mux)
+		if !errors.Is(err, net.ErrClosed) {
+			log.Fatalf("metrics: %v", err)
+		}
+	}()
+}
+
+func counter(w io.Writer, name, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
+
+func gauge(w io.Writer, name, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+}
+
+// writeMetrics renders the proxy counters in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	gauge(w, "mcproxy_tcp_connections", "Active TCP connections.", atomic.LoadInt64(&activeTCP))
+	gauge(w, "mcproxy_udp_associations", "Active UDP associations.", atomic.LoadInt64(&activeUDP))
+	gauge(w, "mcproxy_tarpit_connections", "Refused TCP connections held open by access.tarpit_seconds.", atomic.LoadInt64(&tarpitHeld))
+	gauge(w, "mcproxy_bedrock_players", "UDP associations with an open RakNet session.", atomic.LoadInt64(&bedrockPlayers))
+	counter(w, "mcproxy_status_pings_total", "Status (server list) connections.", atomic.LoadInt64(&statusPings))
+	counter(w, "mcproxy_status_limited_total", "Status connections dropped by the rate limit.", atomic.LoadInt64(&statusLimited))
+	counter(w, "mcproxy_login_attempts_total", "Login connections.", atomic.LoadInt64(&loginAttempts))
+	counter(w, "mcproxy_login_limited_total", "Logins refused by the rate limit.", atomic.LoadInt64(&loginLimited))
+	counter(w, "mcproxy_login_ip_limited_total", "Logins refused by limits.logins_per_ip.", atomic.LoadInt64(&loginIPLimited))
+	counter(w, "mcproxy_protocol_rejected_total", "Logins refused for an unsupported protocol version.", atomic.LoadInt64(&protocolRejected))
+	counter(w, "mcproxy_accept_limited_total", "TCP connections closed right after accept by limits.accept_rate.", atomic.LoadInt64(&acceptLimited))
+	counter(w, "mcproxy_full_rejected_total", "TCP connections and new UDP clients' datagrams refused at a listener's max_connections.", atomic.LoadInt64(&fullRejected))
+	counter(w, "mcproxy_access_denied_total", "TCP connections and UDP sources refused by the access allow and deny lists.", atomic.LoadInt64(&accessDenied))
+	counter(w, "mcproxy_geo_denied_total", "TCP connections and UDP sources refused by the allow_countries and deny_countries of their listener.", atomic.LoadInt64(&geoDenied))
+	counter(w, "mcproxy_asn_denied_total", "TCP connections and UDP sources refused by the deny_asns of their listener.", atomic.LoadInt64(&asnDenied))
+	counter(w, "mcproxy_reputation_flagged_total", "Logins and Bedrock connection requests from addresses the reputation provider flagged.", atomic.LoadInt64(&reputationFlagged))
+	counter(w, "mcproxy_name_denied_total", "Logins refused by the usernames allow and deny lists.", atomic.LoadInt64(&nameDenied))
+	counter(w, "mcproxy_firewall_bans_total", "Addresses added to the firewall ban set.", atomic.LoadInt64(&firewallBans))
+	counter(w, "mcproxy_crowdsec_denied_total", "TCP connections and UDP sources refused by a CrowdSec ban decision.", atomic.LoadInt64(&crowdsecDenied))
+	counter(w, "mcproxy_crowdsec_alerts_total", "Alerts pushed to the CrowdSec local API.", atomic.LoadInt64(&crowdsecAlerted))
+	counter(w, "mcproxy_rule_denied_total", "Connections and UDP datagrams refused by a deny or rate_limit [[rule]].", atomic.LoadInt64(&ruleDenied))
+	counter(w, "mcproxy_silent_dropped_total", "TCP connections closed for sending nothing within first_byte_timeout_ms.", atomic.LoadInt64(&silentDropped))
+	counter(w, "mcproxy_slow_dropped_total", "TCP connections closed for sending their opening over hello_timeout_ms or below hello_min_rate.", atomic.LoadInt64(&slowDropped))
+	counter(w, "mcproxy_invalid_dropped_total", "TCP connections closed for an opening that is not a valid handshake, Login Start or, with validate = \"request\", status request.", atomic.LoadInt64(&invalidDropped))
+	counter(w, "mcproxy_framing_dropped_total", "TCP connections closed for breaking the [framing] rules.", atomic.LoadInt64(&framingDropped))
+	counter(w, "mcproxy_udp_ip_limited_total", "UDP associations refused by limits.udp_associations_per_ip.", atomic.LoadInt64(&udpIPLimited))
+	counter(w, "mcproxy_subnet_limited_total", "TCP connections and UDP associations refused by limits.connections_per_subnet or limits.udp_associations_per_subnet.", atomic.LoadInt64(&subnetLimited))
+	counter(w, "mcproxy_udp_global_limited_total", "UDP associations refused by limits.udp_associations.", atomic.LoadInt64(&udpGlobalLimited))
+	counter(w, "mcproxy_udp_rate_limited_total", "UDP datagrams dropped by limits.udp_packet_rate or limits.udp_byte_rate.", atomic.LoadInt64(&udpRateLimited))
+	counter(w, "mcproxy_udp_queue_dropped_total", "UDP datagrams dropped because the worker queue of their association was full.", atomic.LoadInt64(&udpQueueDropped))
+	counter(w, "mcproxy_udp_malformed_total", "UDP datagrams dropped as empty, larger than datagram_size or, with bedrock.validate, not RakNet.", atomic.LoadInt64(&udpMalformed))
+	counter(w, "mcproxy_cookie_rejected_total", "UDP datagrams dropped by bedrock.cookie: no association and no valid RakNet cookie.", atomic.LoadInt64(&cookieRejected))
+	counter(w, "mcproxy_scanner_pings_total", "Status pings answered by the honeypot.", atomic.LoadInt64(&scannerHits))
+
+	fmt.Fprintf(w, "# HELP mcproxy_udp_packets_total UDP datagrams relayed; up is client to backend.\n# TYPE mcproxy_udp_packets_total counter\n")
+	fmt.Fprintf(w, "mcproxy_udp_packets_total{direction=\"up\"} %d\n", atomic.LoadInt64(&udpPacketsUp))
+	fmt.Fprintf(w, "mcproxy_udp_packets_total{direction=\"down\"} %d\n", atomic.LoadInt64(&udpPacketsDown))
+	fmt.Fprintf(w, "# HELP mcproxy_udp_bytes_total UDP payload bytes relayed; up is client to backend.\n# TYPE mcproxy_udp_bytes_total counter\n")
+	fmt.Fprintf(w, "mcproxy_udp_bytes_total{direction=\"up\"} %d\n", atomic.LoadInt64(&udpBytesUp))
+	fmt.Fprintf(w, "mcproxy_udp_bytes_total{direction=\"down\"} %d\n", atomic.LoadInt64(&udpBytesDown))
+
+	fmt.Fprintf(w, "# HELP mcproxy_backend_up Result of the last health probe.\n# TYPE mcproxy_backend_up gauge\n")
+	fmt.Fprintf(w, "# HELP mcproxy_backend_circuit_open Whether the circuit breaker is holding traffic back.\n# TYPE mcproxy_backend_circuit_open gauge\n")
+	fmt.Fprintf(w, "# HELP mcproxy_backend_connections Active proxied connections to the backend.\n# TYPE mcproxy_backend_connections gauge\n")
+	fmt.Fprintf(w, "# HELP mcproxy_backend_players_online Players online reported by the backend.\n# TYPE mcproxy_backend_players_online gauge\n")
+	fmt.Fprintf(w, "# HELP mcproxy_backend_players_max Player slots reported by the backend.\n# TYPE mcproxy_backend_players_max gauge\n")
+	backendStates.Range(func(k, v any) bool {
+		st := v.(*backendState)
+		up := 0
+		if st.healthy.Load() {
+			up = 1
+		}
+		fmt.Fprintf(w, "mcproxy_backend_up{backend=%q} %d\n", k, up)
+		open := 0
+		if st.circuitOpen() {
+			open = 1
+		}
+		fmt.Fprintf(w, "mcproxy_backend_circuit_open{backend=%q} %d\n", k, open)
+		fmt.Fprintf(w, "mcproxy_backend_connections{backend=%q} %d\n", k, st.active.Load())
+		st.mu.Lock()
+		if st.polled {
+			fmt.Fprintf(w, "mcproxy_backend_players_online{backend=%q} %d\n", k, st.players.Online)
+			fmt.Fprintf(w, "mcproxy_backend_players_max{backend=%q} %d\n", k, st.players.Max)
+		}
+		st.mu.Unlock()
+		return true
+	})
+
+	fmt.Fprintf(w, "# HELP mcproxy_bedrock_backend_players_online Players online in the backend's last unconnected pong.\n# TYPE mcproxy_bedrock_backend_players_online gauge\n")
+	fmt.Fprintf(w, "# HELP mcproxy_bedrock_backend_players_max Player slots in the backend's last unconnected pong.\n# TYPE mcproxy_bedrock_backend_players_max gauge\n")
+	fmt.Fprintf(w, "# HELP mcproxy_bedrock_backend_info MOTD and version in the backend's last unconnected pong.\n# TYPE mcproxy_bedrock_backend_info gauge\n")
+	bedrockStates.Range(func(k, v any) bool {
+		st := v.(*bedrockStatus)
+		st.mu.Lock()
+		fmt.Fprintf(w, "mcproxy_bedrock_backend_players_online{backend=%q} %d\n", k, st.online)
+		fmt.Fprintf(w, "mcproxy_bedrock_backend_players_max{backend=%q} %d\n", k, st.max)
+		fmt.Fprintf(w, "mcproxy_bedrock_backend_info{backend=%q,motd=%q,version=%q} 1\n", k, st.motd, st.version)
+		st.mu.Unlock()
+		return true
+	})
+
+	fmt.Fprintf(w, "# HELP mcproxy_backend_ping_seconds Status ping round-trip time to the backend.\n# TYPE mcproxy_backend_ping_seconds summary\n")
+	latencies.Range(func(k, v any) bool {
+		qs := []float64{0.5, 0.9, 0.99}
+		p, n := v.(*latencyRing).percentiles(qs...)
+		for i, q := range qs {
+			if n > 0 {
+				fmt.Fprintf(w, "mcproxy_backend_ping_seconds{backend=%q,quantile=\"%g\"} %g\n", k, q, p[i].Seconds())
+			}
+		}
+		fmt.Fprintf(w, "mcproxy_backend_ping_seconds_count{backend=%q} %d\n", k, n)
+		return true
+	})
+}
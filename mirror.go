@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// mirror is a best-effort copy of a client's traffic to the shadow backend;
+// whatever the shadow sends back is discarded.
+type mirror struct {
+	ch   chan []byte
+	dead bool
+	// failed is set by the sending goroutine when the shadow cannot be
+	// reached or written to.
+	failed atomic.Bool
+}
+
+// openMirror returns at once: the shadow is dialled in the background, and
+// pending and whatever is written meanwhile wait in the queue.
+func (cfg *Config) openMirror(cliAddr net.Addr, pending []byte) *mirror {
+	m := &mirror{ch: make(chan []byte, 64)}
+	go func() {
+		defer func() {
+			for range m.ch {
+			}
+		}()
+		c, err := connectBackend(cfg, cfg.Backend.Mirror, cliAddr, handshakeTimeout)
+		if err != nil {
+			m.failed.Store(true)
+			cfg.logf("%s: mirror: %v", cliAddr, err)
+			return
+		}
+		defer c.Close()
+		go io.Copy(io.Discard, c)
+		for b := range m.ch {
+			if _, err := c.Write(b); err != nil {
+				m.failed.Store(true)
+				return
+			}
+		}
+	}()
+	m.Write(pending)
+	return m
+}
+
+// Write never blocks the real connection: once the shadow falls behind,
+// mirroring stops for this connection rather than sending it a stream with
+// holes.
+func (m *mirror) Write(b []byte) (int, error) {
+	if m.dead || m.failed.Load() || len(b) == 0 {
+		return len(b), nil
+	}
+	select {
+	case m.ch <- append([]byte(nil), b...):
+	default:
+		m.Close()
+	}
+	return len(b), nil
+}
+
+func (m *mirror) Close() {
+	if !m.dead {
+		m.dead = true
+		close(m.ch)
+	}
+}
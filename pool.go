@@ -0,0 +1,415 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errNoServers = errors.New("pool has no servers")
+
+// slowStartScale gives slow-start room to ramp in small steps.
+const slowStartScale = 100
+
+// Pool is a named group of interchangeable backends that connections are
+// spread across.
+type Pool struct {
+	Name    string       `toml:"name"`
+	Balance string       `toml:"balance"`
+	Servers []PoolServer `toml:"server"`
+
+	FailbackSeconds  int `toml:"failback_seconds"`
+	SlowStartSeconds int `toml:"slow_start_seconds"`
+
+	ConsulService string `toml:"consul_service"`
+	ConsulTag     string `toml:"consul_tag"`
+
+	KubeService   string `toml:"kubernetes_service"`
+	KubeNamespace string `toml:"kubernetes_namespace"`
+	KubePort      string `toml:"kubernetes_port"`
+
+	Canary        string `toml:"canary"`
+	CanaryPercent int    `toml:"canary_percent"`
+
+	canary    *Pool
+	canaryPct atomic.Int32
+
+	members atomic.Pointer[[]PoolServer]
+	next    atomic.Uint32
+	mu      sync.Mutex
+	current map[string]int
+	primary string
+}
+
+type PoolServer struct {
+	Address string `toml:"address"`
+	Weight  int    `toml:"weight"`
+}
+
+// singlePool wraps a bare backend address so that routing always yields a
+// pool.
+func singlePool(addr string) *Pool {
+	return &Pool{Name: addr, Balance: "round_robin", Servers: []PoolServer{{Address: addr, Weight: 1}}}
+}
+
+// discovered reports whether the members come from service discovery
+// rather than the config.
+func (p *Pool) discovered() bool {
+	return p.ConsulService != "" || p.KubeService != ""
+}
+
+// servers returns the current members; discovery replaces the list as a
+// whole, so callers may hold on to it.
+func (p *Pool) servers() []PoolServer {
+	if m := p.members.Load(); m != nil {
+		return *m
+	}
+	return p.Servers
+}
+
+func (p *Pool) init() error {
+	if p.Name == "" || (len(p.Servers) == 0 && !p.discovered()) {
+		return fmt.Errorf("pool: name and at least one server are required")
+	}
+	if p.ConsulService != "" && p.KubeService != "" {
+		return fmt.Errorf("pool %q: consul_service and kubernetes_service are exclusive", p.Name)
+	}
+	switch p.Balance {
+	case "":
+		p.Balance = "round_robin"
+	case "round_robin", "random", "least_connections", "ip_hash", "failover":
+	default:
+		return fmt.Errorf("pool %q: unknown balance %q", p.Name, p.Balance)
+	}
+	if p.CanaryPercent < 0 || p.CanaryPercent > 100 {
+		return fmt.Errorf("pool %q: canary_percent must be between 0 and 100", p.Name)
+	}
+	p.canaryPct.Store(int32(p.CanaryPercent))
+	if p.FailbackSeconds < 0 || p.SlowStartSeconds < 0 {
+		return fmt.Errorf("pool %q: negative failback_seconds or slow_start_seconds", p.Name)
+	}
+	for i := range p.Servers {
+		s := &p.Servers[i]
+		if s.Address == "" {
+			return fmt.Errorf("pool %q: server address is required", p.Name)
+		}
+		switch {
+		case s.Weight == 0:
+			s.Weight = 1
+		case s.Weight < 0:
+			return fmt.Errorf("pool %q: server %s: negative weight", p.Name, s.Address)
+		}
+	}
+	if len(p.Servers) > 0 {
+		p.primary = p.Servers[0].Address
+	}
+	return nil
+}
+
+// split sends canary_percent of the connections to the canary, a pool of
+// that name or a single backend address, and the rest to p.
+func (p *Pool) split() *Pool {
+	if p.canary != nil && rand.IntN(100) < int(p.canaryPct.Load()) {
+		return p.canary
+	}
+	return p
+}
+
+// pick returns a healthy member chosen by the pool's balance policy,
+// leaving out the addresses in skip; a client remembered by [affinity]
+// gets its previous member back. When every member is down it still
+// returns one, and the caller's health check turns that into
+// errBackendDown; with a non-empty skip, or a discovered pool that has
+// no members yet, it returns "" instead.
+func (p *Pool) pick(cliAddr net.Addr, skip map[string]bool) string {
+	servers := p.servers()
+	if len(servers) == 0 {
+		return ""
+	}
+	sticky := p.Balance != "failover"
+	if sticky {
+		if addr := affinity.lookup(p, cliAddr, servers, skip); addr != "" {
+			return addr
+		}
+	}
+	start := int(p.next.Add(1) - 1)
+	up := make([]int, 0, len(servers))
+	weights := make([]int, len(servers))
+	total := 0
+	for i := range servers {
+		k := (start + i) % len(servers)
+		if addr := servers[k].Address; backendHealthy(addr) && !skip[addr] {
+			up = append(up, k)
+			weights[k] = p.weight(servers[k])
+			total += weights[k]
+		}
+	}
+	if len(up) == 0 {
+		if len(skip) > 0 {
+			return ""
+		}
+		return servers[start%len(servers)].Address
+	}
+	best := up[0]
+	switch p.Balance {
+	case "round_robin":
+		best = p.smooth(servers, weights, up, total)
+	case "failover":
+		if len(skip) == 0 {
+			best = p.failover(servers)
+		} else {
+			best = slices.Min(up)
+		}
+	case "random":
+		n := rand.IntN(total)
+		for _, k := range up {
+			if n -= weights[k]; n < 0 {
+				best = k
+				break
+			}
+		}
+	case "least_connections":
+		// compare (active+1)/weight without dividing; the +1 keeps an idle
+		// member in slow-start from taking every new connection
+		ba := stateOf(servers[best].Address).active.Load() + 1
+		for _, k := range up[1:] {
+			a := stateOf(servers[k].Address).active.Load() + 1
+			if a*int64(weights[best]) < ba*int64(weights[k]) {
+				best, ba = k, a
+			}
+		}
+	case "ip_hash":
+		ip := sourceIP(cliAddr).AsSlice()
+		bs := -1.0
+		for _, k := range up {
+			if s := hrwScore(ip, servers[k].Address, weights[k]); s > bs {
+				best, bs = k, s
+			}
+		}
+	}
+	if sticky {
+		affinity.remember(p, cliAddr, servers[best].Address)
+	}
+	return servers[best].Address
+}
+
+// weight is the member's share while picking. With slow_start_seconds a
+// member that just came back up starts near zero and grows linearly to its
+// full weight over the window, so a freshly restarted server is not handed
+// its whole share of players at once.
+func (p *Pool) weight(s PoolServer) int {
+	if p.SlowStartSeconds == 0 {
+		return s.Weight
+	}
+	w := s.Weight * slowStartScale
+	window := time.Duration(p.SlowStartSeconds) * time.Second
+	if up := upFor(s.Address); up < window {
+		w = max(1, int(int64(w)*int64(up)/int64(window)))
+	}
+	return w
+}
+
+// smooth is nginx's smooth weighted round-robin: it spreads each member's
+// turns evenly instead of sending them in bursts.
+func (p *Pool) smooth(servers []PoolServer, weights, up []int, total int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current == nil {
+		p.current = map[string]int{}
+	}
+	best := up[0]
+	for _, k := range up {
+		p.current[servers[k].Address] += weights[k]
+		if p.current[servers[k].Address] > p.current[servers[best].Address] {
+			best = k
+		}
+	}
+	p.current[servers[best].Address] -= total
+	return best
+}
+
+// failover keeps to the first healthy server in declared order. A server
+// that recovers only takes back over after it has stayed healthy for
+// failback_seconds, so a flapping primary does not bounce players around.
+func (p *Pool) failover(servers []PoolServer) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hold := time.Duration(p.FailbackSeconds) * time.Second
+	cur := slices.IndexFunc(servers, func(s PoolServer) bool { return s.Address == p.primary })
+	curUp := cur >= 0 && backendHealthy(servers[cur].Address)
+	next := cur
+	for k := range servers {
+		addr := servers[k].Address
+		if k == cur && curUp {
+			break
+		}
+		if !backendHealthy(addr) {
+			continue
+		}
+		if !curUp || upFor(addr) >= hold {
+			next = k
+			break
+		}
+	}
+	if next < 0 {
+		next = 0
+	}
+	if addr := servers[next].Address; addr != p.primary {
+		if p.primary != "" {
+			log.Printf("pool %s: switching from %s to %s", p.Name, p.primary, addr)
+		}
+		p.primary = addr
+	}
+	return next
+}
+
+// updatePool installs a member list from service discovery, starts probes
+// for new members and forgets the state of members no longer referenced.
+func (cfg *Config) updatePool(p *Pool, list []PoolServer, source string) {
+	old := p.servers()
+	if slices.Equal(old, list) {
+		return
+	}
+	p.members.Store(&list)
+	have := map[string]bool{}
+	for _, s := range list {
+		have[s.Address] = true
+	}
+	for _, s := range old {
+		if !have[s.Address] {
+			log.Printf("pool %s: %s removed by %s", p.Name, s.Address, source)
+			if !slices.Contains(cfg.backendAddrs(), s.Address) {
+				backendStates.Delete(s.Address)
+			}
+		}
+		delete(have, s.Address)
+	}
+	for _, s := range list {
+		if have[s.Address] {
+			log.Printf("pool %s: %s added by %s", p.Name, s.Address, source)
+			cfg.watchBackend(s.Address)
+		}
+	}
+}
+
+// hrwScore ranks a backend for a client (weighted rendezvous hashing): every
+// client keeps its backend while it stays healthy, and only the clients of a
+// removed backend move.
+func hrwScore(ip []byte, addr string, weight int) float64 {
+	h := fnv.New64a()
+	h.Write(ip)
+	h.Write([]byte(addr))
+	u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+	return float64(weight) / -math.Log(u)
+}
+
+// initPools validates [[pool]] and resolves the pool of the default route,
+// of the fallback, of every vhost, route rule and TCP listener.
+func (cfg *Config) initPools() error {
+	cfg.pools = map[string]*Pool{}
+	for i := range cfg.Pools {
+		p := &cfg.Pools[i]
+		if err := p.init(); err != nil {
+			return err
+		}
+		if cfg.pools[p.Name] != nil {
+			return fmt.Errorf("pool %q: defined twice", p.Name)
+		}
+		cfg.pools[p.Name] = p
+	}
+	for i := range cfg.Pools {
+		p := &cfg.Pools[i]
+		switch c := cfg.pools[p.Canary]; {
+		case p.Canary == "":
+		case c == p:
+			return fmt.Errorf("pool %q: canary is the pool itself", p.Name)
+		case c != nil:
+			p.canary = c
+		default:
+			p.canary = singlePool(p.Canary)
+		}
+	}
+	if f := cfg.Backend.Fallback; f != "" {
+		if cfg.fallback = cfg.pools[f]; cfg.fallback == nil {
+			cfg.fallback = singlePool(f)
+		}
+	}
+	var err error
+	if cfg.defaultPool, err = cfg.poolFor(cfg.Backend.Pool, cfg.Routing.DefaultBackend); err != nil {
+		return fmt.Errorf("backend.pool: %v", err)
+	}
+	for i := range cfg.VHosts {
+		v := &cfg.VHosts[i]
+		if v.pool, err = cfg.poolFor(v.Pool, v.Backend); err != nil {
+			return fmt.Errorf("vhost: %v", err)
+		}
+	}
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if r.Action == "route" && r.Protocol != "udp" {
+			if r.pool, err = cfg.poolFor(r.Pool, r.Backend); err != nil {
+				return fmt.Errorf("rule %d: %v", r.index, err)
+			}
+		}
+	}
+	for i := range cfg.Listeners {
+		switch l := &cfg.Listeners[i]; {
+		case l.Protocol != "tcp":
+		case l.Pool == "" && l.Backend == "":
+			l.pool = cfg.defaultPool
+		default:
+			if l.pool, err = cfg.poolFor(l.Pool, l.Backend); err != nil {
+				return fmt.Errorf("listener %s: %v", l.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) poolFor(name, addr string) (*Pool, error) {
+	if name == "" {
+		return singlePool(addr), nil
+	}
+	p := cfg.pools[name]
+	if p == nil {
+		return nil, fmt.Errorf("unknown pool %q", name)
+	}
+	return p, nil
+}
+
+// canaryCommand shows or changes the canary share of a pool at runtime:
+// "canary" lists them, "canary <pool> <percent>" sets one.
+func (cfg *Config) canaryCommand(args []string) {
+	if len(args) == 0 {
+		for i := range cfg.Pools {
+			if p := &cfg.Pools[i]; p.canary != nil {
+				log.Printf("canary: pool %s -> %s %d%%", p.Name, p.canary.Name, p.canaryPct.Load())
+			}
+		}
+		return
+	}
+	p := cfg.pools[args[0]]
+	pct, err := 0, error(nil)
+	if len(args) == 2 {
+		pct, err = strconv.Atoi(strings.TrimSuffix(args[1], "%"))
+	}
+	switch {
+	case len(args) != 2 || err != nil || pct < 0 || pct > 100:
+		log.Printf("usage: canary [<pool> <percent>]")
+	case p == nil || p.canary == nil:
+		log.Printf("canary: pool %q has no canary", args[0])
+	default:
+		p.canaryPct.Store(int32(pct))
+		log.Printf("canary: pool %s -> %s %d%%", p.Name, p.canary.Name, pct)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type ProxyTLV struct {
+	Type  int    `toml:"type"`
+	Value string `toml:"value"`
+	Hex   string `toml:"hex"`
+
+	raw []byte
+}
+
+func (t *ProxyTLV) init() error {
+	if t.Type < 0 || t.Type > 0xff {
+		return fmt.Errorf("tlv type %d out of range", t.Type)
+	}
+	t.raw = []byte(t.Value)
+	if t.Hex != "" {
+		b, err := hex.DecodeString(t.Hex)
+		if err != nil {
+			return fmt.Errorf("tlv 0x%02x: %v", t.Type, err)
+		}
+		t.raw = b
+	}
+	if len(t.raw) > 0xffff {
+		return fmt.Errorf("tlv 0x%02x: value too long", t.Type)
+	}
+	return nil
+}
+
+// proxyV2MaxAddrs is the size of the largest address block, two IPv6
+// addresses and ports.
+const proxyV2MaxAddrs = 36
+
+// checkProxyTLVs makes sure the TLVs fit a v2 header next to any address
+// block: its length field is 16 bits.
+func checkProxyTLVs(tlvs []ProxyTLV) error {
+	n := 0
+	for _, t := range tlvs {
+		n += 3 + len(t.raw)
+	}
+	if n > 0xffff-proxyV2MaxAddrs {
+		return fmt.Errorf("%d bytes of TLVs, at most %d fit a header", n, 0xffff-proxyV2MaxAddrs)
+	}
+	return nil
+}
+
+func proxyHeader(mode string, src, dst net.Addr, tlvs []ProxyTLV) []byte {
+	if mode == "v2" {
+		return proxyV2(src, dst, tlvs)
+	}
+	return proxyV1(src, dst)
+}
+
+func addrIPPort(a net.Addr) (net.IP, int) {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// anyAddr stands in for the destination when the backend is not reached
+// over IP (a unix socket), so the header still carries the client address.
+// It returns nil, and so PROXY UNKNOWN, when the client is not IP either.
+func anyAddr(src net.Addr) net.Addr {
+	ip, _ := addrIPPort(src)
+	switch {
+	case ip == nil:
+		return nil
+	case ip.To4() != nil:
+		return &net.TCPAddr{IP: net.IPv4zero}
+	}
+	return &net.TCPAddr{IP: net.IPv6unspecified}
+}
+
+// proxyIPs normalizes both ends to one address family. Mixed pairs are
+// promoted to IPv6 with v4-mapped addresses; ok is false when either side
+// is not an IP endpoint.
+func proxyIPs(sip, dip net.IP) (s, d netip.Addr, v6, ok bool) {
+	if sip == nil || dip == nil {
+		return s, d, false, false
+	}
+	if s4, d4 := sip.To4(), dip.To4(); s4 != nil && d4 != nil {
+		return netip.AddrFrom4([4]byte(s4)), netip.AddrFrom4([4]byte(d4)), false, true
+	}
+	s16, d16 := sip.To16(), dip.To16()
+	if s16 == nil || d16 == nil {
+		return s, d, false, false
+	}
+	return netip.AddrFrom16([16]byte(s16)), netip.AddrFrom16([16]byte(d16)), true, true
+}
+
+func proxyV1(src, dst net.Addr) []byte {
+	sip, sport := addrIPPort(src)
+	dip, dport := addrIPPort(dst)
+	s, d, v6, ok := proxyIPs(sip, dip)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	fam := "TCP4"
+	if v6 {
+		fam = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", fam, s, d, sport, dport))
+}
+
+func proxyV2(src, dst net.Addr, tlvs []ProxyTLV) []byte {
+	sip, sport := addrIPPort(src)
+	dip, dport := addrIPPort(dst)
+
+	proto := byte(0x1)
+	if _, ok := src.(*net.UDPAddr); ok {
+		proto = 0x2
+	}
+
+	var addrs []byte
+	fam := byte(0x1)
+	s, d, v6, ok := proxyIPs(sip, dip)
+	switch {
+	case !ok:
+		fam, proto = 0, 0
+	case v6:
+		fam = 0x2
+		fallthrough
+	default:
+		addrs = append(addrs, s.AsSlice()...)
+		addrs = append(addrs, d.AsSlice()...)
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(sport))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(dport))
+	}
+	for _, t := range tlvs {
+		addrs = append(addrs, byte(t.Type))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(len(t.raw)))
+		addrs = append(addrs, t.raw...)
+	}
+
+	hdr := make([]byte, 0, 16+len(addrs))
+	hdr = append(hdr, proxyV2Sig...)
+	hdr = append(hdr, 0x21, fam<<4|proto)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func trustedSource(a net.Addr, trusted []netip.Prefix) bool {
+	ip, _ := addrIPPort(a)
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader consumes an inbound PROXY v1 or v2 header and returns the
+// source address it carries. A nil address means the sender did not convey
+// one (UNKNOWN or LOCAL) and the socket peer should be used.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] == 'P' {
+		return readProxyV1(r)
+	}
+	return readProxyV2(r)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("proxy v1: header too long")
+	}
+	f := strings.Fields(s)
+	if len(f) < 2 || f[0] != "PROXY" {
+		return nil, errors.New("proxy v1: bad header")
+	}
+	if f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("proxy v1: bad header %q", s)
+	}
+	ip, err := netip.ParseAddr(f[2])
+	if err != nil {
+		return nil, fmt.Errorf("proxy v1: %v", err)
+	}
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy v1: %v", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Sig) || hdr[12]>>4 != 2 {
+		return nil, errors.New("proxy v2: bad signature")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0xf == 0 {
+		return nil, nil
+	}
+	var ip netip.Addr
+	var port uint16
+	switch hdr[13] >> 4 {
+	case 0x1:
+		if len(body) < 12 {
+			return nil, errors.New("proxy v2: short ipv4 block")
+		}
+		ip = netip.AddrFrom4([4]byte(body[0:4]))
+		port = binary.BigEndian.Uint16(body[8:])
+	case 0x2:
+		if len(body) < 36 {
+			return nil, errors.New("proxy v2: short ipv6 block")
+		}
+		ip = netip.AddrFrom16([16]byte(body[0:16]))
+		port = binary.BigEndian.Uint16(body[32:])
+	default:
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+}
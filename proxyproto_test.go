@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	a, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func udpAddrOf(s string) *net.UDPAddr {
+	a, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func TestProxyV1(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		want     string
+	}{
+		{"ipv4", tcpAddr("192.0.2.7:50000"), tcpAddr("10.0.0.1:25565"),
+			"PROXY TCP4 192.0.2.7 10.0.0.1 50000 25565\r\n"},
+		{"ipv6", tcpAddr("[2001:db8::7]:50000"), tcpAddr("[2001:db8::1]:25565"),
+			"PROXY TCP6 2001:db8::7 2001:db8::1 50000 25565\r\n"},
+		{"ipv4 client, ipv6 backend", tcpAddr("192.0.2.7:50000"), tcpAddr("[2001:db8::1]:25565"),
+			"PROXY TCP6 ::ffff:192.0.2.7 2001:db8::1 50000 25565\r\n"},
+		{"ipv6 client, ipv4 backend", tcpAddr("[2001:db8::7]:50000"), tcpAddr("10.0.0.1:25565"),
+			"PROXY TCP6 2001:db8::7 ::ffff:10.0.0.1 50000 25565\r\n"},
+		{"mapped client, ipv4 backend", tcpAddr("[::ffff:192.0.2.7]:50000"), tcpAddr("10.0.0.1:25565"),
+			"PROXY TCP4 192.0.2.7 10.0.0.1 50000 25565\r\n"},
+		{"mapped on both ends", tcpAddr("[::ffff:192.0.2.7]:50000"), tcpAddr("[::ffff:10.0.0.1]:25565"),
+			"PROXY TCP4 192.0.2.7 10.0.0.1 50000 25565\r\n"},
+		{"unix client", &net.UnixAddr{Name: "@", Net: "unix"}, tcpAddr("10.0.0.1:25565"),
+			"PROXY UNKNOWN\r\n"},
+		{"unix backend", tcpAddr("192.0.2.7:50000"), nil,
+			"PROXY UNKNOWN\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(proxyV1(tt.src, tt.dst)); got != tt.want {
+				t.Errorf("proxyV1 = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// v2header builds a v2 header by hand: signature, version and command,
+// family and protocol, length, body.
+func v2header(famProto byte, body ...[]byte) []byte {
+	b := bytes.Join(body, nil)
+	h := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, famProto, byte(len(b)>>8), byte(len(b)))
+	return append(h, b...)
+}
+
+func TestProxyV2(t *testing.T) {
+	ports := []byte{0xc3, 0x50, 0x63, 0xdd} // 50000, 25565
+	v4 := func(s string) []byte { return net.ParseIP(s).To4() }
+	v6 := func(s string) []byte { return net.ParseIP(s).To16() }
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		tlvs     []ProxyTLV
+		want     []byte
+	}{
+		{"ipv4", tcpAddr("192.0.2.7:50000"), tcpAddr("10.0.0.1:25565"), nil,
+			v2header(0x11, v4("192.0.2.7"), v4("10.0.0.1"), ports)},
+		{"ipv6", tcpAddr("[2001:db8::7]:50000"), tcpAddr("[2001:db8::1]:25565"), nil,
+			v2header(0x21, v6("2001:db8::7"), v6("2001:db8::1"), ports)},
+		{"ipv4 client, ipv6 backend", tcpAddr("192.0.2.7:50000"), tcpAddr("[2001:db8::1]:25565"), nil,
+			v2header(0x21, v6("::ffff:192.0.2.7"), v6("2001:db8::1"), ports)},
+		{"ipv6 client, ipv4 backend", tcpAddr("[2001:db8::7]:50000"), tcpAddr("10.0.0.1:25565"), nil,
+			v2header(0x21, v6("2001:db8::7"), v6("::ffff:10.0.0.1"), ports)},
+		{"mapped client, ipv4 backend", tcpAddr("[::ffff:192.0.2.7]:50000"), tcpAddr("10.0.0.1:25565"), nil,
+			v2header(0x11, v4("192.0.2.7"), v4("10.0.0.1"), ports)},
+		{"udp ipv4 client, ipv6 backend", udpAddrOf("192.0.2.7:50000"), udpAddrOf("[2001:db8::1]:25565"), nil,
+			v2header(0x22, v6("::ffff:192.0.2.7"), v6("2001:db8::1"), ports)},
+		{"unix client", &net.UnixAddr{Name: "@", Net: "unix"}, tcpAddr("10.0.0.1:25565"), nil,
+			v2header(0x00)},
+		{"tlv", tcpAddr("192.0.2.7:50000"), tcpAddr("10.0.0.1:25565"), []ProxyTLV{{Type: 0xe0, raw: []byte("eu")}},
+			v2header(0x11, v4("192.0.2.7"), v4("10.0.0.1"), ports, []byte{0xe0, 0, 2, 'e', 'u'})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := proxyV2(tt.src, tt.dst, tt.tlvs); !bytes.Equal(got, tt.want) {
+				t.Errorf("proxyV2 =\n% x\nwant\n% x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyRoundTrip(t *testing.T) {
+	src, dst := tcpAddr("192.0.2.7:50000"), tcpAddr("[2001:db8::1]:25565")
+	for _, mode := range []string{"v1", "v2"} {
+		got, err := readProxyHeader(bufio.NewReader(bytes.NewReader(proxyHeader(mode, src, dst, nil))))
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if a := got.(*net.TCPAddr).AddrPort(); a.Addr().Unmap().String() != "192.0.2.7" || a.Port() != 50000 {
+			t.Errorf("%s: source %v, want 192.0.2.7:50000", mode, got)
+		}
+	}
+}
+
+func TestCheckProxyTLVs(t *testing.T) {
+	fits := []ProxyTLV{{raw: make([]byte, 0xffff-proxyV2MaxAddrs-3)}}
+	if err := checkProxyTLVs(fits); err != nil {
+		t.Errorf("largest TLV refused: %v", err)
+	}
+	over := []ProxyTLV{{raw: make([]byte, 40000)}, {raw: make([]byte, 40000)}}
+	if err := checkProxyTLVs(over); err == nil || !strings.Contains(err.Error(), "fit") {
+		t.Errorf("oversized TLVs: err = %v", err)
+	}
+}
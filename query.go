@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query answers the GameSpy4 query protocol that Java servers speak with
+// enable-query, from the backend's status. The challenge token is derived
+// from the client address like the RakNet cookie, so the proxy keeps no
+// per-client state and spoofed stat requests get nothing.
+type Query struct {
+	Enabled      bool   `toml:"enabled"`
+	Backend      string `toml:"backend"`
+	CacheSeconds int    `toml:"cache_seconds"`
+	GameType     string `toml:"game_type"`
+	Map          string `toml:"map"`
+
+	cookies *addrCookies
+}
+
+const (
+	queryHandshake = 0x09
+	queryStat      = 0x00
+)
+
+var queryMagic = []byte{0xfe, 0xfd}
+
+// queryDoc is the part of a status response a query reply needs.
+type queryDoc struct {
+	Version     statusVersion   `json:"version"`
+	Description json.RawMessage `json:"description"`
+	Players     struct {
+		Max    int `json:"max"`
+		Online int `json:"online"`
+		Sample []struct {
+			Name string `json:"name"`
+		} `json:"sample"`
+	} `json:"players"`
+}
+
+func isQuery(p []byte) bool {
+	return len(p) >= 7 && bytes.Equal(p[:2], queryMagic)
+}
+
+// answerQuery replies to a query packet on pc. Stat requests need the
+// backend status, so they are answered from a goroutine.
+func (cfg *Config) answerQuery(pc net.PacketConn, p []byte, addr *net.UDPAddr) {
+	q := &cfg.Query
+	session := append([]byte(nil), p[3:7]...)
+	key := addr.AddrPort()
+	switch p[2] {
+	case queryHandshake:
+		out := append([]byte{queryHandshake}, session...)
+		out = strconv.AppendInt(out, int64(int32(q.cookies.issue(key))), 10)
+		pc.WriteTo(append(out, 0), addr)
+	case queryStat:
+		if len(p) < 11 || !q.cookies.valid(key, binary.BigEndian.Uint32(p[7:11])) {
+			return
+		}
+		full := len(p) >= 15
+		go func() {
+			d, ok := cfg.queryInfo(addr)
+			if !ok {
+				return
+			}
+			pc.WriteTo(cfg.queryReply(session, d, full), addr)
+		}()
+	}
+}
+
+func (cfg *Config) queryInfo(cliAddr net.Addr) (queryDoc, bool) {
+	var d queryDoc
+	addr := cfg.Query.Backend
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(addr, "tls://"))
+	p, _ := strconv.Atoi(port)
+	hs := handshake{Protocol: cfg.Health.Protocol, Host: host, Port: uint16(p), NextState: stateStatus}
+	ttl := time.Duration(cfg.Query.CacheSeconds) * time.Second
+	st, err := statuses.get(addr+"|query", ttl, func() (status, error) {
+		json, rtt, err := queryStatus(cfg, addr, hs, nil, handshakeTimeout)
+		return status{json, rtt, hs.Protocol}, err
+	})
+	if err != nil {
+		cfg.logf("%s: query: status: %v", cliAddr, err)
+		return d, false
+	}
+	if err := json.Unmarshal([]byte(cfg.localStatus(st, cliAddr)), &d); err != nil {
+		cfg.logf("%s: query: status json: %v", cliAddr, err)
+		return d, false
+	}
+	return d, true
+}
+
+// queryReply encodes a basic or full stat response the way vanilla servers
+// do, host port in little endian included.
+func (cfg *Config) queryReply(session []byte, d queryDoc, full bool) []byte {
+	q := &cfg.Query
+	hostIP, hostPort := "0.0.0.0", 25565
+	if ap, err := netip.ParseAddrPort(cfg.Listen.TCP); err == nil {
+		hostIP, hostPort = ap.Addr().String(), int(ap.Port())
+	} else if _, port, err := net.SplitHostPort(cfg.Listen.TCP); err == nil {
+		hostPort, _ = strconv.Atoi(port)
+	}
+	motd := chatText(d.Description)
+	out := append([]byte{queryStat}, session...)
+	str := func(s string) {
+		out = append(out, s...)
+		out = append(out, 0)
+	}
+	if !full {
+		str(motd)
+		str(q.GameType)
+		str(q.Map)
+		str(strconv.Itoa(d.Players.Online))
+		str(strconv.Itoa(d.Players.Max))
+		out = binary.LittleEndian.AppendUint16(out, uint16(hostPort))
+		str(hostIP)
+		return out
+	}
+	out = append(out, "splitnum\x00\x80\x00"...)
+	for _, kv := range [][2]string{
+		{"hostname", motd},
+		{"gametype", q.GameType},
+		{"game_id", "MINECRAFT"},
+		{"version", d.Version.Name},
+		{"plugins", ""},
+		{"map", q.Map},
+		{"numplayers", strconv.Itoa(d.Players.Online)},
+		{"maxplayers", strconv.Itoa(d.Players.Max)},
+		{"hostport", strconv.Itoa(hostPort)},
+		{"hostip", hostIP},
+	} {
+		str(kv[0])
+		str(kv[1])
+	}
+	out = append(out, 0)
+	out = append(out, "\x01player_\x00\x00"...)
+	for _, p := range d.Players.Sample {
+		str(p.Name)
+	}
+	return append(out, 0)
+}
+
+// chatText flattens a chat component (a string or an object with text and
+// extra) to its plain text.
+func chatText(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var c struct {
+		Text  string            `json:"text"`
+		Extra []json.RawMessage `json:"extra"`
+	}
+	if json.Unmarshal(raw, &c) != nil {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(c.Text)
+	for _, e := range c.Extra {
+		b.WriteString(chatText(e))
+	}
+	return b.String()
+}
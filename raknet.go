@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	raknetUnconnectedPing        = 0x01
+	raknetOpenConnectionsPing    = 0x02
+	raknetOpenConnectionRequest1 = 0x05
+	raknetOpenConnectionReply1   = 0x06
+	raknetOpenConnectionRequest2 = 0x07
+	raknetOpenConnectionReply2   = 0x08
+	raknetDisconnect             = 0x15
+	raknetUnconnectedPong        = 0x1c
+)
+
+var raknetMagic = []byte{0x00, 0xff, 0xff, 0x00, 0xfe, 0xfe, 0xfe, 0xfe, 0xfd, 0xfd, 0xfd, 0xfd, 0x12, 0x34, 0x56, 0x78}
+
+type Bedrock struct {
+	MOTD       string `toml:"motd"`
+	SubMOTD    string `toml:"sub_motd"`
+	Version    string `toml:"version"`
+	Online     int    `toml:"online"`
+	MaxPlayers int    `toml:"max_players"`
+	Cookie     bool   `toml:"cookie"`
+	Validate   bool   `toml:"validate"`
+}
+
+func (b *Bedrock) rewrites() bool {
+	return b.MOTD != "" || b.SubMOTD != "" || b.Version != "" || b.Online > 0 || b.MaxPlayers > 0
+}
+
+// parsePong splits an unconnected pong into its fixed prefix (id, time,
+// server GUID, magic) and the ';'-separated server ID fields
+// (edition;motd;protocol;version;online;max;guid;sub motd;gamemode;...).
+func parsePong(p []byte) (prefix []byte, fields []string, ok bool) {
+	if len(p) < 35 || p[0] != raknetUnconnectedPong || !bytes.Equal(p[17:33], raknetMagic) {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(p[33:35]))
+	if len(p) < 35+n {
+		return nil, nil, false
+	}
+	return p[:33], strings.Split(string(p[35:35+n]), ";"), true
+}
+
+// bedrockStatus is what a UDP backend last reported in its pong.
+type bedrockStatus struct {
+	mu      sync.Mutex
+	motd    string
+	version string
+	online  int
+	max     int
+	seen    time.Time
+}
+
+// bedrockStates maps UDP backend addresses to their *bedrockStatus.
+var bedrockStates sync.Map
+
+// recordPong remembers the MOTD, version and player counts of a backend's
+// unconnected pong, before any [bedrock] override.
+func recordPong(backend string, p []byte) {
+	_, f, ok := parsePong(p)
+	if !ok || len(f) < 6 {
+		return
+	}
+	v, _ := bedrockStates.LoadOrStore(backend, &bedrockStatus{})
+	st := v.(*bedrockStatus)
+	st.mu.Lock()
+	st.motd, st.version = f[1], f[3]
+	st.online, _ = strconv.Atoi(f[4])
+	st.max, _ = strconv.Atoi(f[5])
+	st.seen = time.Now()
+	st.mu.Unlock()
+}
+
+func bedrockReport() []string {
+	var lines []string
+	bedrockStates.Range(func(k, v any) bool {
+		st := v.(*bedrockStatus)
+		st.mu.Lock()
+		lines = append(lines, fmt.Sprintf("%s players=%d/%d version=%q motd=%q age=%v", k, st.online, st.max,
+			st.version, st.motd, time.Since(st.seen).Round(time.Second)))
+		st.mu.Unlock()
+		return true
+	})
+	sort.Strings(lines)
+	return lines
+}
+
+// rewritePong applies the [bedrock] overrides to a backend's unconnected
+// pong. The MOTD lines may use the same placeholders as the Java MOTD.
+func (cfg *Config) rewritePong(p []byte) []byte {
+	prefix, f, ok := parsePong(p)
+	if !ok || len(f) < 6 {
+		return p
+	}
+	var d statusDoc
+	d.Players.Online, _ = strconv.Atoi(f[4])
+	d.Players.Max, _ = strconv.Atoi(f[5])
+	d.Version.Name = f[3]
+
+	b := &cfg.Bedrock
+	if b.Online > 0 {
+		f[4] = strconv.Itoa(b.Online)
+	}
+	if b.MaxPlayers > 0 {
+		f[5] = strconv.Itoa(b.MaxPlayers)
+	}
+	if b.Version != "" {
+		f[3] = b.Version
+	}
+	if b.MOTD != "" {
+		f[1] = sanitizePongField(cfg.renderMOTD(b.MOTD, d, 0))
+	}
+	if b.SubMOTD != "" && len(f) > 7 {
+		f[7] = sanitizePongField(cfg.renderMOTD(b.SubMOTD, d, 0))
+	}
+
+	id := strings.Join(f, ";")
+	out := make([]byte, 0, len(prefix)+2+len(id))
+	out = append(out, prefix...)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(id)))
+	return append(out, id...)
+}
+
+// raknetOpenRequest reports whether p is one of the open connection requests
+// a client sends to join, as opposed to a ping or a stray datagram.
+func raknetOpenRequest(p []byte) bool {
+	switch {
+	case len(p) >= 18 && p[0] == raknetOpenConnectionRequest1:
+	case len(p) >= 34 && p[0] == raknetOpenConnectionRequest2:
+	default:
+		return false
+	}
+	return bytes.Equal(p[1:17], raknetMagic)
+}
+
+// raknetValid reports whether p looks like a datagram a Bedrock client
+// sends: an offline message carrying the magic, or a connected frame set,
+// ACK or NAK long enough for its header.
+func raknetValid(p []byte) bool {
+	switch {
+	case len(p) == 0:
+		return false
+	case p[0] == raknetUnconnectedPing || p[0] == raknetOpenConnectionsPing:
+		return raknetPing(p)
+	case p[0] == raknetOpenConnectionRequest1 || p[0] == raknetOpenConnectionRequest2:
+		return raknetOpenRequest(p)
+	case p[0]&0x80 == 0:
+		return false
+	case p[0]&0x60 != 0:
+		// ACK or NAK: record count
+		return len(p) >= 3
+	default:
+		// frame set: 24-bit sequence number and at least a frame header
+		return len(p) >= 7
+	}
+}
+
+// raknetOpenReply reports whether p is the backend's open connection reply 2,
+// which accepts the client.
+func raknetOpenReply(p []byte) bool {
+	return len(p) >= 25 && p[0] == raknetOpenConnectionReply2 && bytes.Equal(p[1:17], raknetMagic)
+}
+
+// raknetDisconnected reports whether p is a frame set carrying a disconnect
+// notification. Split frames are skipped: the notification is never split.
+func raknetDisconnected(p []byte) bool {
+	if len(p) < 4 || p[0]&0xe0 != 0x80 {
+		return false
+	}
+	p = p[4:]
+	for len(p) >= 3 {
+		flags := p[0]
+		n := (int(binary.BigEndian.Uint16(p[1:3])) + 7) / 8
+		p = p[3:]
+		// reliable, sequenced and ordered frames carry 3-byte indexes, the
+		// ordered ones also a channel
+		var skip int
+		switch flags >> 5 {
+		case 2, 6:
+			skip = 3
+		case 1, 3, 7:
+			skip = 3 + 4
+		case 4:
+			skip = 3 + 3 + 4
+		}
+		split := flags&0x10 != 0
+		if split {
+			skip += 10
+		}
+		if len(p) < skip+n {
+			return false
+		}
+		if !split && n > 0 && p[skip] == raknetDisconnect {
+			return true
+		}
+		p = p[skip+n:]
+	}
+	return false
+}
+
+func sanitizePongField(s string) string {
+	return strings.ReplaceAll(s, ";", "")
+}
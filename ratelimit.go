@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Limits struct {
+	AcceptRate        float64 `toml:"accept_rate"`
+	AcceptBurst       int     `toml:"accept_burst"`
+	StatusRate        float64 `toml:"status_rate"`
+	StatusBurst       int     `toml:"status_burst"`
+	LoginRate         float64 `toml:"login_rate"`
+	LoginBurst        int     `toml:"login_burst"`
+	LoginLimitMessage string  `toml:"login_limit_message"`
+	LoginsPerIP       int     `toml:"logins_per_ip"`
+	LoginsPerIPSecs   float64 `toml:"logins_per_ip_seconds"`
+	LoginIPMessage    string  `toml:"login_ip_message"`
+	UDPPerIP          int     `toml:"udp_associations_per_ip"`
+	UDPPerSubnet      int     `toml:"udp_associations_per_subnet"`
+	TCPPerSubnet      int     `toml:"connections_per_subnet"`
+	UDPAssociations   int     `toml:"udp_associations"`
+	UDPPacketRate     float64 `toml:"udp_packet_rate"`
+	UDPPacketBurst    int     `toml:"udp_packet_burst"`
+	UDPByteRate       float64 `toml:"udp_byte_rate"`
+	UDPByteBurst      int     `toml:"udp_byte_burst"`
+
+	accept        *tokenBucket
+	status, login *tokenBucket
+	loginIP       *ipBuckets
+	udpSources    *udpSources
+}
+
+func (l *Limits) init() {
+	l.accept = newTokenBucket(l.AcceptRate, l.AcceptBurst)
+	l.status = newTokenBucket(l.StatusRate, l.StatusBurst)
+	l.login = newTokenBucket(l.LoginRate, l.LoginBurst)
+	if l.LoginsPerIP > 0 && l.LoginsPerIPSecs > 0 {
+		// logins_per_ip at once, then one every logins_per_ip_seconds / logins_per_ip
+		l.loginIP = newIPBuckets(float64(l.LoginsPerIP)/l.LoginsPerIPSecs, l.LoginsPerIP)
+	}
+	if l.UDPPacketRate > 0 || l.UDPByteRate > 0 {
+		l.udpSources = &udpSources{m: map[netip.Addr]*udpSource{}}
+	}
+}
+
+// merge fills the fields l leaves at zero from base, so a listener's
+// [listener.limits] only has to name the limits it changes.
+func (l *Limits) merge(base Limits) {
+	if l.AcceptRate == 0 {
+		l.AcceptRate = base.AcceptRate
+	}
+	if l.AcceptBurst == 0 {
+		l.AcceptBurst = base.AcceptBurst
+	}
+	if l.StatusRate == 0 {
+		l.StatusRate = base.StatusRate
+	}
+	if l.StatusBurst == 0 {
+		l.StatusBurst = base.StatusBurst
+	}
+	if l.LoginRate == 0 {
+		l.LoginRate = base.LoginRate
+	}
+	if l.LoginBurst == 0 {
+		l.LoginBurst = base.LoginBurst
+	}
+	if l.LoginLimitMessage == "" {
+		l.LoginLimitMessage = base.LoginLimitMessage
+	}
+	if l.LoginsPerIP == 0 {
+		l.LoginsPerIP = base.LoginsPerIP
+	}
+	if l.LoginsPerIPSecs == 0 {
+		l.LoginsPerIPSecs = base.LoginsPerIPSecs
+	}
+	if l.LoginIPMessage == "" {
+		l.LoginIPMessage = base.LoginIPMessage
+	}
+	if l.UDPPerIP == 0 {
+		l.UDPPerIP = base.UDPPerIP
+	}
+	if l.UDPPerSubnet == 0 {
+		l.UDPPerSubnet = base.UDPPerSubnet
+	}
+	if l.TCPPerSubnet == 0 {
+		l.TCPPerSubnet = base.TCPPerSubnet
+	}
+	if l.UDPAssociations == 0 {
+		l.UDPAssociations = base.UDPAssociations
+	}
+	if l.UDPPacketRate == 0 {
+		l.UDPPacketRate = base.UDPPacketRate
+	}
+	if l.UDPPacketBurst == 0 {
+		l.UDPPacketBurst = base.UDPPacketBurst
+	}
+	if l.UDPByteRate == 0 {
+		l.UDPByteRate = base.UDPByteRate
+	}
+	if l.UDPByteBurst == 0 {
+		l.UDPByteBurst = base.UDPByteBurst
+	}
+}
+
+// checkUDP makes sure the byte bucket holds a datagram of the given size,
+// or nothing that large would ever pass.
+func (l *Limits) checkUDP(datagram int) error {
+	burst := float64(l.UDPByteBurst)
+	if burst < 1 {
+		burst = l.UDPByteRate
+	}
+	if l.UDPByteRate > 0 && burst < float64(datagram) {
+		return fmt.Errorf("udp_byte_burst (or udp_byte_rate without it) is below datagram_size %d", datagram)
+	}
+	return nil
+}
+
+// udpSources holds the packet and byte buckets of each UDP source IP.
+type udpSources struct {
+	mu      sync.Mutex
+	m       map[netip.Addr]*udpSource
+	cleaned time.Time
+}
+
+type udpSource struct {
+	packets, bytes *tokenBucket
+}
+
+// allowUDP takes a datagram of n bytes from ip out of its buckets.
+func (l *Limits) allowUDP(ip netip.Addr, n int) bool {
+	t := l.udpSources
+	if t == nil {
+		return true
+	}
+	now := time.Now()
+	t.mu.Lock()
+	s := t.m[ip]
+	if s == nil {
+		s = &udpSource{
+			packets: newTokenBucket(l.UDPPacketRate, l.UDPPacketBurst),
+			bytes:   newTokenBucket(l.UDPByteRate, l.UDPByteBurst),
+		}
+		t.m[ip] = s
+	}
+	// sources whose buckets have refilled are no different from new ones
+	if now.Sub(t.cleaned) > 10*time.Second {
+		t.cleaned = now
+		for k, s := range t.m {
+			if s.packets.full(now) && s.bytes.full(now) {
+				delete(t.m, k)
+			}
+		}
+	}
+	t.mu.Unlock()
+	if !takeBoth(s.packets, 1, s.bytes, float64(n)) {
+		atomic.AddInt64(&udpRateLimited, 1)
+		return false
+	}
+	return true
+}
+
+// admitUDP checks a new UDP association from ip against the per-IP,
+// per-subnet and process-wide caps and, when it fits, counts it for ip and
+// its subnet. It returns the cap that refused it, or "".
+func (l *Limits) admitUDP(ip netip.Addr) string {
+	if l.UDPAssociations > 0 && atomic.LoadInt64(&activeUDP) >= int64(l.UDPAssociations) {
+		atomic.AddInt64(&udpGlobalLimited, 1)
+		return "udp_associations"
+	}
+	sub := subnetOf(ip)
+	udpPerIP.mu.Lock()
+	defer udpPerIP.mu.Unlock()
+	if l.UDPPerIP > 0 && udpPerIP.m[ip] >= l.UDPPerIP {
+		atomic.AddInt64(&udpIPLimited, 1)
+		return "udp_associations_per_ip"
+	}
+	if l.UDPPerSubnet > 0 && udpPerIP.subnets[sub] >= l.UDPPerSubnet {
+		atomic.AddInt64(&subnetLimited, 1)
+		return "udp_associations_per_subnet"
+	}
+	udpPerIP.m[ip]++
+	udpPerIP.subnets[sub]++
+	return ""
+}
+
+// udpPerIP counts the UDP associations of each source IP and subnet.
+var udpPerIP = struct {
+	mu      sync.Mutex
+	m       map[netip.Addr]int
+	subnets map[netip.Prefix]int
+}{m: map[netip.Addr]int{}, subnets: map[netip.Prefix]int{}}
+
+func releaseUDP(ip netip.Addr) {
+	sub := subnetOf(ip)
+	udpPerIP.mu.Lock()
+	if udpPerIP.m[ip]--; udpPerIP.m[ip] <= 0 {
+		delete(udpPerIP.m, ip)
+	}
+	if udpPerIP.subnets[sub]--; udpPerIP.subnets[sub] <= 0 {
+		delete(udpPerIP.subnets, sub)
+	}
+	udpPerIP.mu.Unlock()
+}
+
+// subnetOf returns the /24 of an IPv4 or the /48 of an IPv6 address: the
+// networks botnets tend to rotate their addresses within.
+func subnetOf(ip netip.Addr) netip.Prefix {
+	ip = ip.Unmap()
+	bits := 48
+	if ip.Is4() {
+		bits = 24
+	}
+	p, _ := ip.Prefix(bits)
+	return p
+}
+
+// tcpPerSubnet counts the open TCP connections of each subnet, while
+// limits.connections_per_subnet is set.
+var tcpPerSubnet = struct {
+	mu sync.Mutex
+	m  map[netip.Prefix]int
+}{m: map[netip.Prefix]int{}}
+
+// admitTCP counts a TCP connection from ip against connections_per_subnet;
+// false when its subnet already has that many open. Sources without an IP
+// are not limited. A connection admitted with the limit set must be given
+// back with releaseTCP.
+func (l *Limits) admitTCP(ip netip.Addr) bool {
+	if l.TCPPerSubnet <= 0 || !ip.IsValid() {
+		return true
+	}
+	sub := subnetOf(ip)
+	tcpPerSubnet.mu.Lock()
+	defer tcpPerSubnet.mu.Unlock()
+	if tcpPerSubnet.m[sub] >= l.TCPPerSubnet {
+		atomic.AddInt64(&subnetLimited, 1)
+		return false
+	}
+	tcpPerSubnet.m[sub]++
+	return true
+}
+
+func (l *Limits) releaseTCP(ip netip.Addr) {
+	if l.TCPPerSubnet <= 0 || !ip.IsValid() {
+		return
+	}
+	sub := subnetOf(ip)
+	tcpPerSubnet.mu.Lock()
+	if tcpPerSubnet.m[sub]--; tcpPerSubnet.m[sub] <= 0 {
+		delete(tcpPerSubnet.m, sub)
+	}
+	tcpPerSubnet.mu.Unlock()
+}
+
+// udpDropLogged throttles the log of refused associations: a spoofed flood
+// would otherwise write a line per datagram.
+var udpDropLogged atomic.Int64
+
+func (cfg *Config) logUDPDrop(addr net.Addr, limit string) {
+	now := time.Now().Unix()
+	if last := udpDropLogged.Load(); now-last < 10 || !udpDropLogged.CompareAndSwap(last, now) {
+		return
+	}
+	cfg.logf("%s: udp association refused by limits.%s (refused so far: %d per ip, %d per subnet, %d total)", addr, limit,
+		atomic.LoadInt64(&udpIPLimited), atomic.LoadInt64(&subnetLimited), atomic.LoadInt64(&udpGlobalLimited))
+}
+
+// ipBuckets keeps a token bucket per source IP.
+type ipBuckets struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	m       map[netip.Addr]*tokenBucket
+	cleaned time.Time
+}
+
+func newIPBuckets(rate float64, burst int) *ipBuckets {
+	return &ipBuckets{rate: rate, burst: burst, m: map[netip.Addr]*tokenBucket{}}
+}
+
+// take reports whether ip may go on; a nil set lets everything through.
+func (t *ipBuckets) take(ip netip.Addr) bool {
+	if t == nil {
+		return true
+	}
+	now := time.Now()
+	t.mu.Lock()
+	b := t.m[ip]
+	if b == nil {
+		b = newTokenBucket(t.rate, t.burst)
+		t.m[ip] = b
+	}
+	if now.Sub(t.cleaned) > 10*time.Second {
+		t.cleaned = now
+		for k, b := range t.m {
+			if b.full(now) {
+				delete(t.m, k)
+			}
+		}
+	}
+	t.mu.Unlock()
+	return b.allow()
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil (no limit) when rate is zero. Without a burst
+// the bucket holds a second's worth, but never less than one token, or a
+// rate below 1 would let nothing through.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b < 1 {
+		b = max(1, rate)
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+func (b *tokenBucket) allow() bool {
+	return b.take(1)
+}
+
+func (b *tokenBucket) take(n float64) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// takeBoth takes na from a and nb from b, or nothing when either falls
+// short, so that one bucket refusing does not drain the other.
+func takeBoth(a *tokenBucket, na float64, b *tokenBucket, nb float64) bool {
+	if a == nil {
+		return b.take(nb)
+	}
+	if b == nil {
+		return a.take(na)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	a.refill(now)
+	b.refill(now)
+	if a.tokens < na || b.tokens < nb {
+		return false
+	}
+	a.tokens -= na
+	b.tokens -= nb
+	return true
+}
+
+// full reports whether the bucket has refilled completely by now.
+func (b *tokenBucket) full(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
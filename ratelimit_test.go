@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketFractionalRate(t *testing.T) {
+	b := newTokenBucket(0.5, 0)
+	if !b.allow() {
+		t.Fatal("first take refused at rate 0.5 without burst")
+	}
+	if b.allow() {
+		t.Fatal("second take allowed before refill")
+	}
+	// two seconds at 0.5/s put one token back
+	b.last = b.last.Add(-2 * time.Second)
+	if !b.allow() {
+		t.Fatal("take refused after refill")
+	}
+	if b.allow() {
+		t.Fatal("refill went over the burst")
+	}
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	tests := []struct {
+		rate  float64
+		burst int
+		want  float64
+	}{
+		{0.2, 0, 1},
+		{10, 0, 10},
+		{10, 3, 3},
+		{0.5, 4, 4},
+	}
+	for _, tt := range tests {
+		if got := newTokenBucket(tt.rate, tt.burst).burst; got != tt.want {
+			t.Errorf("newTokenBucket(%v, %d).burst = %v, want %v", tt.rate, tt.burst, got, tt.want)
+		}
+	}
+	if newTokenBucket(0, 5) != nil {
+		t.Error("zero rate gave a bucket")
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	b := newTokenBucket(10, 5)
+	if !b.take(5) || b.take(1) {
+		t.Fatal("burst of 5 not taken exactly")
+	}
+	b.last = b.last.Add(-200 * time.Millisecond)
+	if !b.take(2) || b.take(1) {
+		t.Fatal("200ms at 10/s did not refill 2 tokens")
+	}
+	b.last = b.last.Add(-time.Hour)
+	if !b.full(time.Now()) {
+		t.Error("bucket not full after an hour")
+	}
+	if !b.take(5) || b.take(1) {
+		t.Fatal("refill not capped at the burst")
+	}
+}
+
+func TestTakeBoth(t *testing.T) {
+	tests := []struct {
+		name   string
+		na, nb float64
+		ok     bool
+	}{
+		{"both fit", 1, 100, true},
+		{"a short", 3, 100, false},
+		{"b short", 1, 2000, false},
+		{"both short", 3, 2000, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newTokenBucket(1, 2), newTokenBucket(1000, 1000)
+			if got := takeBoth(a, tt.na, b, tt.nb); got != tt.ok {
+				t.Fatalf("takeBoth = %v, want %v", got, tt.ok)
+			}
+			wantA, wantB := 2.0, 1000.0
+			if tt.ok {
+				wantA, wantB = 2-tt.na, 1000-tt.nb
+			}
+			// refill may add a few microseconds' worth
+			if a.tokens < wantA || a.tokens > wantA+0.01 || b.tokens < wantB || b.tokens > wantB+1 {
+				t.Errorf("tokens = %v, %v; want %v, %v", a.tokens, b.tokens, wantA, wantB)
+			}
+		})
+	}
+	if !takeBoth(nil, 1, nil, 1) {
+		t.Error("nil buckets refused")
+	}
+	a := newTokenBucket(1, 1)
+	if !takeBoth(a, 1, nil, 1e9) || takeBoth(a, 1, nil, 0) {
+		t.Error("nil b does not fall back to a alone")
+	}
+}
+
+func TestLimitsMerge(t *testing.T) {
+	base := Limits{AcceptRate: 50, LoginRate: 5, LoginBurst: 10, LoginLimitMessage: "slow down", UDPByteRate: 1e6}
+	l := Limits{LoginRate: 1, TCPPerSubnet: 8}
+	l.merge(base)
+	want := Limits{AcceptRate: 50, LoginRate: 1, LoginBurst: 10, LoginLimitMessage: "slow down", TCPPerSubnet: 8, UDPByteRate: 1e6}
+	if l != want {
+		t.Errorf("merged = %+v\nwant %+v", l, want)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reputation asks an IP reputation API whether a client comes from a VPN,
+// proxy or hosting network. Logins wait for the answer, at most timeout_ms;
+// verdicts are cached per IP, and a failed lookup lets the client in.
+type Reputation struct {
+	Provider     string `toml:"provider"`
+	Key          string `toml:"key"`
+	URL          string `toml:"url"`
+	Action       string `toml:"action"`
+	KickMessage  string `toml:"kick_message"`
+	CacheSeconds int    `toml:"cache_seconds"`
+	TimeoutMs    int    `toml:"timeout_ms"`
+
+	client *http.Client
+}
+
+// reputationErrorTTL is how long a failed lookup counts as clean before
+// the address is asked about again.
+const reputationErrorTTL = time.Minute
+
+// reputationURLs are the endpoints of the built-in providers; {ip} and
+// {key} are filled in per lookup.
+var reputationURLs = map[string]string{
+	"iphub":      "https://v2.api.iphub.info/ip/{ip}",
+	"proxycheck": "https://proxycheck.io/v2/{ip}?vpn=1&key={key}",
+	"ip-api":     "http://ip-api.com/json/{ip}?fields=status,message,proxy,hosting",
+}
+
+func (r *Reputation) enabled() bool {
+	return r.Provider != ""
+}
+
+func (r *Reputation) init() error {
+	if _, ok := reputationURLs[r.Provider]; !ok {
+		return fmt.Errorf("unknown provider %q", r.Provider)
+	}
+	switch r.Action {
+	case "deny", "kick", "tag":
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	if r.CacheSeconds < 1 || r.TimeoutMs < 1 {
+		return fmt.Errorf("cache_seconds and timeout_ms must be positive")
+	}
+	if r.URL == "" {
+		r.URL = reputationURLs[r.Provider]
+	}
+	r.client = &http.Client{Timeout: time.Duration(r.TimeoutMs) * time.Millisecond}
+	return nil
+}
+
+type repEntry struct {
+	ready   chan struct{}
+	flagged bool
+	expires time.Time
+}
+
+// reputationMaxPending bounds the lookups started for UDP clients that
+// are still running, so a flood of new addresses cannot open unbounded
+// requests to the API.
+const reputationMaxPending = 64
+
+var reputations = struct {
+	mu      sync.Mutex
+	m       map[netip.Addr]*repEntry
+	pruned  time.Time
+	pending int
+}{m: map[netip.Addr]*repEntry{}}
+
+// entry returns the cache entry of ip and whether the caller has to fill it.
+// With bounded set it returns nil instead of a new entry while
+// reputationMaxPending lookups are running.
+func (r *Reputation) entry(ip netip.Addr, bounded bool) (*repEntry, bool) {
+	now := time.Now()
+	t := &reputations
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e := t.m[ip]; e != nil {
+		select {
+		case <-e.ready:
+			if now.Before(e.expires) {
+				return e, false
+			}
+		default:
+			return e, false
+		}
+	}
+	if now.Sub(t.pruned) > time.Minute {
+		t.pruned = now
+		for k, e := range t.m {
+			select {
+			case <-e.ready:
+				if now.After(e.expires) {
+					delete(t.m, k)
+				}
+			default:
+			}
+		}
+	}
+	if bounded && t.pending >= reputationMaxPending {
+		return nil, false
+	}
+	e := &repEntry{ready: make(chan struct{})}
+	t.m[ip] = e
+	t.pending++
+	return e, true
+}
+
+func (r *Reputation) fill(e *repEntry, ip netip.Addr) {
+	flagged, err := r.lookup(ip)
+	ttl := time.Duration(r.CacheSeconds) * time.Second
+	if err != nil {
+		log.Printf("reputation: %s: %v", ip, err)
+		flagged, ttl = false, reputationErrorTTL
+	}
+	e.flagged, e.expires = flagged, time.Now().Add(ttl)
+	close(e.ready)
+	reputations.mu.Lock()
+	reputations.pending--
+	reputations.mu.Unlock()
+}
+
+// flagged reports whether ip has a bad reputation, waiting for the lookup.
+// Addresses that are not public are never looked up.
+func (r *Reputation) flagged(ip netip.Addr) bool {
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	e, fill := r.entry(ip, false)
+	if fill {
+		r.fill(e, ip)
+	}
+	<-e.ready
+	return e.flagged
+}
+
+// cached reports the verdict on ip without waiting: known is false while
+// the lookup, started here if need be, is still running, or while too many
+// are running to start it.
+func (r *Reputation) cached(ip netip.Addr) (flagged, known bool) {
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false, true
+	}
+	e, fill := r.entry(ip, true)
+	if e == nil {
+		return false, false
+	}
+	if fill {
+		go r.fill(e, ip)
+		return false, false
+	}
+	select {
+	case <-e.ready:
+		return e.flagged, true
+	default:
+		return false, false
+	}
+}
+
+func (r *Reputation) lookup(ip netip.Addr) (bool, error) {
+	u := strings.NewReplacer("{ip}", ip.String(), "{key}", r.Key).Replace(r.URL)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	if r.Provider == "iphub" {
+		req.Header.Set("X-Key", r.Key)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+	switch r.Provider {
+	case "iphub":
+		// block 1 is a hosting, VPN or proxy network; 2 is unsure
+		var v struct {
+			Block int `json:"block"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&v)
+		return v.Block == 1, err
+	case "proxycheck":
+		var v map[string]json.RawMessage
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+			return false, err
+		}
+		var status, message string
+		json.Unmarshal(v["status"], &status)
+		json.Unmarshal(v["message"], &message)
+		if status == "error" || status == "denied" {
+			return false, fmt.Errorf("proxycheck: %s", message)
+		}
+		var res struct {
+			Proxy string `json:"proxy"`
+		}
+		json.Unmarshal(v[ip.String()], &res)
+		return res.Proxy == "yes", nil
+	default:
+		var v struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+			Proxy   bool   `json:"proxy"`
+			Hosting bool   `json:"hosting"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+			return false, err
+		}
+		if v.Status == "fail" {
+			return false, fmt.Errorf("ip-api: %s", v.Message)
+		}
+		return v.Proxy || v.Hosting, nil
+	}
+}
+
+// admitLogin checks a login against the reputation of its source and
+// reports whether it may go on. Flagged logins are logged whatever the
+// action.
+func (cfg *Config) admitLogin(l *Listener, client net.Conn, h *clientHello, cliAddr net.Addr) bool {
+	r := &cfg.Reputation
+	if !r.flagged(sourceIP(cliAddr)) {
+		return true
+	}
+	atomic.AddInt64(&reputationFlagged, 1)
+	cfg.logf("%s: login %q flagged by %s reputation (%s)", cliAddr, h.login.Name, r.Provider, r.Action)
+	if r.Action == "tag" {
+		return true
+	}
+	l.securityEvent(r.Action, "reputation", sourceIP(cliAddr), h.login.Name)
+	if r.Action == "kick" {
+		client.Write(loginDisconnect(r.KickMessage))
+	}
+	return false
+}
+
+// admitUDP checks a client opening a RakNet connection. The datagram is
+// dropped while its lookup runs; clients resend the request, and by then
+// the verdict is cached. With the tag action nothing waits. Behind the
+// cookie gate it is only asked once the cookie checks out, so spoofed
+// sources never reach the API.
+func (r *Reputation) admitUDP(ip netip.Addr) bool {
+	flagged, known := r.cached(ip)
+	if flagged {
+		atomic.AddInt64(&reputationFlagged, 1)
+	}
+	return r.Action == "tag" || known && !flagged
+}
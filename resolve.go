@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resolvedAddrs maps backend "host:port" entries given by name to the
+// "ip:port" last resolved for them.
+var resolvedAddrs sync.Map
+
+// dialAddr returns the address to dial for a configured backend: the cached
+// resolution when periodic re-resolution is on, otherwise addr itself. SRV
+// backends are looked up on every call when they are not cached.
+func dialAddr(addr string) string {
+	if v, ok := resolvedAddrs.Load(addr); ok {
+		return v.(string)
+	}
+	addr = strings.TrimPrefix(addr, "tls://")
+	if isSRV(addr) {
+		if a, err := lookupBackend(addr); err == nil {
+			return a
+		}
+	}
+	return addr
+}
+
+// splitHostPort returns the host of a "host:port" address. An IPv6 address
+// written without brackets gets an error saying how to write it.
+func splitHostPort(addr string) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil {
+		return host, nil
+	}
+	if i := strings.LastIndexByte(addr, ':'); i > 0 {
+		if ip, perr := netip.ParseAddr(addr[:i]); perr == nil && ip.Is6() {
+			return "", fmt.Errorf("%s: IPv6 addresses need brackets: [%s]:%s", addr, addr[:i], addr[i+1:])
+		}
+	}
+	return "", err
+}
+
+// checkBackendAddr validates the form of a configured backend address.
+func checkBackendAddr(addr string) error {
+	addr = strings.TrimPrefix(addr, "tls://")
+	if strings.HasPrefix(addr, "unix:") || isSRV(addr) {
+		return nil
+	}
+	_, err := splitHostPort(addr)
+	return err
+}
+
+func isHostname(addr string) bool {
+	addr = strings.TrimPrefix(addr, "tls://")
+	host, _, err := net.SplitHostPort(addr)
+	if strings.HasPrefix(addr, "unix:") {
+		return false
+	}
+	return isSRV(addr) || err == nil && net.ParseIP(host) == nil
+}
+
+// isSRV reports whether the backend is given as an SRV name such as
+// "_minecraft._tcp.example.com".
+func isSRV(addr string) bool {
+	return strings.HasPrefix(addr, "_") && !strings.Contains(addr, ":")
+}
+
+// srvDomain strips the service and protocol labels, leaving the domain a
+// client would have typed.
+func srvDomain(addr string) string {
+	parts := strings.SplitN(addr, ".", 3)
+	return parts[len(parts)-1]
+}
+
+// lookupBackend resolves a backend to "ip:port", preferring the
+// backend.prefer_family address. SRV records are ordered by priority and
+// shuffled by weight, and the first one is used like a vanilla client does.
+func lookupBackend(addr string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	addr = strings.TrimPrefix(addr, "tls://")
+	if isSRV(addr) {
+		_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", addr)
+		if err != nil {
+			return "", err
+		}
+		if len(srvs) == 0 {
+			return "", fmt.Errorf("no SRV records")
+		}
+		addr = net.JoinHostPort(strings.TrimSuffix(srvs[0].Target, "."), strconv.Itoa(int(srvs[0].Port)))
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	first, second := byFamily(ips)
+	if first = append(first, second...); len(first) == 0 {
+		return "", fmt.Errorf("no addresses for %s", host)
+	}
+	return net.JoinHostPort(first[0].String(), port), nil
+}
+
+type udpAddr struct {
+	addr *net.UDPAddr
+	at   time.Time
+}
+
+// udpAddrs caches the addresses of UDP backends given by name when there
+// is no periodic re-resolution; udpResolving holds the lookups under way.
+var udpAddrs, udpResolving sync.Map
+
+// udpResolveTTL is how long such an address is used before it is looked up
+// again.
+const udpResolveTTL = time.Minute
+
+// udpBackendAddr returns the address of a UDP backend: the literal one, the
+// one the resolver keeps up to date or the cached lookup. Without wait it
+// never blocks: a name not looked up yet is an error, and an outdated one is
+// used while it is looked up again in the background.
+func udpBackendAddr(target string, wait bool) (*net.UDPAddr, error) {
+	a := strings.TrimPrefix(target, "tls://")
+	if v, ok := resolvedAddrs.Load(target); ok {
+		a = v.(string)
+	}
+	if ap, err := netip.ParseAddrPort(a); err == nil {
+		return net.UDPAddrFromAddrPort(ap), nil
+	}
+	v, ok := udpAddrs.Load(target)
+	if ok && time.Since(v.(udpAddr).at) < udpResolveTTL {
+		return v.(udpAddr).addr, nil
+	}
+	if wait {
+		return lookupUDP(target)
+	}
+	if _, busy := udpResolving.LoadOrStore(target, true); !busy {
+		go func() {
+			defer udpResolving.Delete(target)
+			if _, err := lookupUDP(target); err != nil {
+				log.Printf("resolve udp backend %s: %v", target, err)
+			}
+		}()
+	}
+	if ok {
+		return v.(udpAddr).addr, nil
+	}
+	return nil, fmt.Errorf("udp backend %s: still resolving", target)
+}
+
+func lookupUDP(target string) (*net.UDPAddr, error) {
+	next, err := lookupBackend(target)
+	if err != nil {
+		return nil, err
+	}
+	ap, err := netip.ParseAddrPort(next)
+	if err != nil {
+		return nil, err
+	}
+	addr := net.UDPAddrFromAddrPort(ap)
+	udpAddrs.Store(target, udpAddr{addr, time.Now()})
+	return addr, nil
+}
+
+// resolveBackend looks the backend up again and logs when its address
+// changes.
+func resolveBackend(addr string) {
+	next, err := lookupBackend(addr)
+	if err != nil {
+		log.Printf("resolve backend %s: %v", addr, err)
+		return
+	}
+	if prev, ok := resolvedAddrs.Swap(addr, next); !ok || prev.(string) != next {
+		log.Printf("backend %s resolves to %s", addr, next)
+	}
+}
+
+// refreshBackend re-resolves a backend after a failed dial so a DNS
+// failover is picked up before the next interval.
+func refreshBackend(addr string) {
+	if _, ok := resolvedAddrs.Load(addr); ok {
+		go resolveBackend(addr)
+	}
+}
+
+func (cfg *Config) startResolver() {
+	if cfg.Backend.ResolveSecs <= 0 {
+		// look the UDP backends up ahead of their first clients
+		for _, addr := range cfg.udpBackendAddrs() {
+			if isHostname(addr) {
+				udpBackendAddr(addr, false)
+			}
+		}
+		return
+	}
+	var names []string
+	addrs := cfg.backendAddrs()
+	for i := range cfg.Listeners {
+		addrs = append(addrs, cfg.Listeners[i].Backends...)
+	}
+	slices.Sort(addrs)
+	for _, addr := range slices.Compact(addrs) {
+		if isHostname(addr) {
+			resolveBackend(addr)
+			names = append(names, addr)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	interval := time.Duration(cfg.Backend.ResolveSecs) * time.Second
+	go func() {
+		for {
+			time.Sleep(interval)
+			for _, addr := range names {
+				resolveBackend(addr)
+			}
+		}
+	}()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// Rule is one entry of the ordered [[rule]] policy. A connection matches a
+// rule when it meets every condition the rule sets. The first allow, deny or
+// route rule it matches decides; a rate_limit rule refuses only the
+// connections over its rate and lets the others on down the list. Without
+// a deciding rule the connection goes through as usual.
+type Rule struct {
+	Action   string   `toml:"action"`
+	Source   []string `toml:"source"`
+	Listener []string `toml:"listener"`
+	Protocol string   `toml:"protocol"`
+	Host     []string `toml:"host"`
+	Version  []string `toml:"version"`
+	Backend  string   `toml:"backend"`
+	Pool     string   `toml:"pool"`
+	Rate     float64  `toml:"rate"`
+	Burst    int      `toml:"burst"`
+	Message  string   `toml:"message"`
+
+	index    int
+	sources  []netip.Prefix
+	versions []protoRange
+	pool     *Pool
+	limit    *ipBuckets
+}
+
+func (r *Rule) init(index int) error {
+	r.index = index
+	switch r.Action {
+	case "allow", "deny":
+	case "route":
+		if (r.Backend == "") == (r.Pool == "") {
+			return fmt.Errorf("rule %d: route needs one of backend or pool", index)
+		}
+		if r.Backend != "" {
+			if err := checkBackendAddr(r.Backend); err != nil {
+				return fmt.Errorf("rule %d: backend: %v", index, err)
+			}
+		}
+	case "rate_limit":
+		if r.Rate <= 0 || r.Burst < 0 {
+			return fmt.Errorf("rule %d: rate_limit needs a positive rate", index)
+		}
+		r.limit = newIPBuckets(r.Rate, r.Burst)
+	default:
+		return fmt.Errorf("rule %d: unknown action %q", index, r.Action)
+	}
+	switch r.Protocol {
+	case "", "tcp":
+	case "udp":
+		if len(r.Host) > 0 || len(r.Version) > 0 || r.Pool != "" {
+			return fmt.Errorf("rule %d: host, version and pool never match udp", index)
+		}
+	default:
+		return fmt.Errorf("rule %d: unknown protocol %q", index, r.Protocol)
+	}
+	for _, s := range r.Source {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			r.sources = append(r.sources, p.Masked())
+		} else if a, err := netip.ParseAddr(s); err == nil {
+			a = a.Unmap()
+			r.sources = append(r.sources, netip.PrefixFrom(a, a.BitLen()))
+		} else {
+			return fmt.Errorf("rule %d: source %q is not an address or CIDR", index, s)
+		}
+	}
+	for i, h := range r.Host {
+		r.Host[i] = normalizeHost(h)
+	}
+	var err error
+	if r.versions, err = parseProtoRanges(r.Version); err != nil {
+		return fmt.Errorf("rule %d: version: %v", index, err)
+	}
+	return nil
+}
+
+// match tests the conditions. Host and version come from the handshake, so
+// rules that set them never match UDP datagrams or legacy pings. On UDP a
+// route rule needs a backend: pools are TCP only.
+func (r *Rule) match(l *Listener, ip netip.Addr, h *clientHello) bool {
+	switch {
+	case len(r.sources) > 0 && !slices.ContainsFunc(r.sources, func(p netip.Prefix) bool { return p.Contains(ip) }):
+		return false
+	case len(r.Listener) > 0 && !slices.Contains(r.Listener, l.Name):
+		return false
+	case r.Protocol != "" && r.Protocol != l.Protocol:
+		return false
+	case l.Protocol == "udp" && r.Action == "route" && r.Backend == "":
+		return false
+	case len(r.Host) == 0 && len(r.versions) == 0:
+		return true
+	case h == nil || h.legacy:
+		return false
+	}
+	host := normalizeHost(h.hs.Host)
+	if len(r.Host) > 0 && !slices.ContainsFunc(r.Host, func(p string) bool { return hostMatch(p, host) }) {
+		return false
+	}
+	return protoAllowed(r.versions, h.hs.Protocol)
+}
+
+// refuses reports whether the deciding rule turns the connection away.
+func (r *Rule) refuses() bool {
+	return r != nil && (r.Action == "deny" || r.Action == "rate_limit")
+}
+
+// ruleFor runs a connection down the rules and returns the one deciding it,
+// or nil. h is nil for UDP.
+func (cfg *Config) ruleFor(l *Listener, cliAddr net.Addr, h *clientHello) *Rule {
+	ip := sourceIP(cliAddr)
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if !r.match(l, ip, h) {
+			continue
+		}
+		if r.Action != "rate_limit" || !r.limit.take(ip) {
+			return r
+		}
+	}
+	return nil
+}
+
+// refuseRule closes a TCP connection a rule turned away; a login gets the
+// rule's message first.
+func (cfg *Config) refuseRule(l *Listener, client net.Conn, h *clientHello, cliAddr net.Addr, r *Rule) {
+	atomic.AddInt64(&ruleDenied, 1)
+	action := "deny"
+	if r.Action == "rate_limit" {
+		action = "ratelimit"
+	}
+	if h.legacy || h.hs.NextState != stateLogin {
+		l.securityEvent(action, "rule", sourceIP(cliAddr), "")
+		return
+	}
+	l.securityEvent(action, "rule", sourceIP(cliAddr), h.login.Name)
+	cfg.logf("%s: login %q refused by rule %d (%s)", cliAddr, h.login.Name, r.index, r.Action)
+	if r.Message != "" {
+		client.Write(loginDisconnect(r.Message))
+	}
+}
+
+// hostMatch compares a normalized hostname with a vhost-style pattern:
+// an exact name or "*.example.com" for its subdomains.
+func hostMatch(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// SecurityLog writes a line per refused TCP client (deny, rate limit or
+// kick) to its own file in a fixed format, for fail2ban and similar tools:
+//
+//	2006-01-02T15:04:05Z mcproxy action=kick reason=username ip=203.0.113.7 listener=tcp player="bob"
+//
+// The player field is only there for logins. UDP refusals are left out:
+// their sources can be forged, and banning them would ban the victims.
+type SecurityLog struct {
+	Path string `toml:"path"`
+}
+
+var securityLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// open starts the log; "-" is standard error.
+func (s *SecurityLog) open() error {
+	f := os.Stderr
+	if s.Path != "-" {
+		var err error
+		if f, err = os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640); err != nil {
+			return err
+		}
+	}
+	securityLog.mu.Lock()
+	securityLog.path, securityLog.f = s.Path, f
+	securityLog.mu.Unlock()
+	return nil
+}
+
+// reopen opens the file again after logrotate has moved it.
+func (s *SecurityLog) reopen() {
+	securityLog.mu.Lock()
+	defer securityLog.mu.Unlock()
+	if securityLog.f == nil || securityLog.path == "-" {
+		return
+	}
+	f, err := os.OpenFile(securityLog.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		log.Printf("security_log: reopen: %v", err)
+		return
+	}
+	securityLog.f.Close()
+	securityLog.f = f
+}
+
+// securityEvent records a refused client and counts it towards a firewall
+// ban and a CrowdSec alert; player is "" unless it was a login.
+func (l *Listener) securityEvent(action, reason string, ip netip.Addr, player string) {
+	if !ip.IsValid() {
+		return
+	}
+	l.cfg.Firewall.record(ip.Unmap())
+	if reason != "crowdsec" {
+		// CrowdSec knows about its own bans already
+		l.cfg.CrowdSec.record(ip.Unmap(), reason)
+	}
+	securityLog.mu.Lock()
+	defer securityLog.mu.Unlock()
+	if securityLog.f == nil {
+		return
+	}
+	line := fmt.Sprintf("%s mcproxy action=%s reason=%s ip=%s listener=%s", time.Now().UTC().Format(time.RFC3339),
+		action, reason, ip.Unmap(), l.Name)
+	if player != "" {
+		line += fmt.Sprintf(" player=%q", player)
+	}
+	fmt.Fprintln(securityLog.f, line)
+}
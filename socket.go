@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Socket tunes TCP connections. NoDelay left unset keeps Go's default of
+// TCP_NODELAY on, so the small packets of the game leave without waiting to
+// be coalesced; buffer sizes of 0 keep the kernel's. DSCP marks the packets
+// sent on TCP connections and UDP sockets alike, 0 leaves them unmarked.
+type Socket struct {
+	NoDelay       *bool `toml:"nodelay"`
+	SendBuffer    int   `toml:"send_buffer"`
+	ReceiveBuffer int   `toml:"receive_buffer"`
+	DSCP          int   `toml:"dscp"`
+}
+
+// set applies the options to a connection; unix sockets only take the
+// buffer sizes.
+func (s *Socket) set(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		if s.NoDelay != nil {
+			tc.SetNoDelay(*s.NoDelay)
+		}
+		s.setDSCP(tc)
+	}
+	bc, ok := c.(interface {
+		SetReadBuffer(int) error
+		SetWriteBuffer(int) error
+	})
+	if !ok {
+		return
+	}
+	if s.SendBuffer > 0 {
+		if err := bc.SetWriteBuffer(s.SendBuffer); err != nil {
+			log.Printf("socket: send_buffer: %v", err)
+		}
+	}
+	if s.ReceiveBuffer > 0 {
+		if err := bc.SetReadBuffer(s.ReceiveBuffer); err != nil {
+			log.Printf("socket: receive_buffer: %v", err)
+		}
+	}
+}
+
+// setDSCP sets the traffic class of a TCP or UDP socket. Both the IPv4 and
+// the IPv6 option are set: a dual-stack socket uses IP_TOS for IPv4-mapped
+// peers, and only one of them needs to take.
+func (s *Socket) setDSCP(c net.Conn) {
+	if s.DSCP == 0 {
+		return
+	}
+	tos := s.DSCP << 2
+	err4 := ipv4.NewConn(c).SetTOS(tos)
+	err6 := ipv6.NewConn(c).SetTrafficClass(tos)
+	if err4 != nil && err6 != nil {
+		log.Printf("socket: dscp: %v", err4)
+	}
+}
+
+// merge fills the options left unset from base.
+func (s *Socket) merge(base Socket) {
+	if s.NoDelay == nil {
+		s.NoDelay = base.NoDelay
+	}
+	if s.SendBuffer == 0 {
+		s.SendBuffer = base.SendBuffer
+	}
+	if s.ReceiveBuffer == 0 {
+		s.ReceiveBuffer = base.ReceiveBuffer
+	}
+	if s.DSCP == 0 {
+		s.DSCP = base.DSCP
+	}
+}
+
+func (s *Socket) valid() bool {
+	return s.SendBuffer >= 0 && s.ReceiveBuffer >= 0 && s.DSCP >= 0 && s.DSCP < 64
+}
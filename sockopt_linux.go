@@ -0,0 +1,44 @@
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const reusePortSupported = true
+
+// reusePortControl sets SO_REUSEPORT so that several sockets can listen on
+// one address, with the kernel spreading new connections across them.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return setsockopt(c, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
+
+const fastOpenSupported = true
+
+// fastOpenQueue is the TCP_FASTOPEN backlog of a listener: how many
+// connections may be waiting on their data-carrying SYN at once.
+const fastOpenQueue = 256
+
+// fastOpenListenControl lets clients send data in the SYN (TCP Fast Open).
+func fastOpenListenControl(network, address string, c syscall.RawConn) error {
+	return setsockopt(c, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, fastOpenQueue)
+}
+
+// fastOpenDialControl sets TCP_FASTOPEN_CONNECT: once the kernel holds a
+// cookie for the backend, connect returns at once and the first write goes
+// out in the SYN.
+func fastOpenDialControl(network, address string, c syscall.RawConn) error {
+	return setsockopt(c, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+}
+
+func setsockopt(c syscall.RawConn, level, opt, value int) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), level, opt, value)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const reusePortSupported = false
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("reuse_port is only supported on linux")
+}
+
+const fastOpenSupported = false
+
+func fastOpenListenControl(network, address string, c syscall.RawConn) error {
+	return errors.New("fast_open is only supported on linux")
+}
+
+func fastOpenDialControl(network, address string, c syscall.RawConn) error {
+	return errors.New("fast_open is only supported on linux")
+}
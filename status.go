@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxStatusLen = 1 << 20
+
+type StatusConfig struct {
+	CacheTTLSeconds int    `toml:"cache_ttl_seconds"`
+	MOTD            string `toml:"motd"`
+	OfflineMOTD     string `toml:"offline_motd"`
+	OfflineVersion  string `toml:"offline_version"`
+	Favicon         string `toml:"favicon"`
+	FaviconMode     string `toml:"favicon_mode"`
+	TrackLatency    bool   `toml:"track_latency"`
+	GeoMOTD         []struct {
+		Countries  []string `toml:"countries"`
+		Continents []string `toml:"continents"`
+		MOTD       string   `toml:"motd"`
+	} `toml:"geo_motd"`
+
+	favicon string
+}
+
+// local reports whether status requests are answered by the proxy.
+func (s *StatusConfig) local() bool {
+	return s.CacheTTLSeconds > 0 || s.MOTD != "" || s.favicon != "" || len(s.GeoMOTD) > 0
+}
+
+// motdFor picks the MOTD template for the client: the first geo_motd entry
+// matching its country or continent, else the global motd.
+func (s *StatusConfig) motdFor(cliAddr net.Addr) string {
+	if len(s.GeoMOTD) == 0 {
+		return s.MOTD
+	}
+	country, continent := geoLookup(cliAddr)
+	for _, g := range s.GeoMOTD {
+		if (country != "" && slices.Contains(g.Countries, country)) ||
+			(continent != "" && slices.Contains(g.Continents, continent)) {
+			return g.MOTD
+		}
+	}
+	return s.MOTD
+}
+
+// loadFavicon reads a PNG (64x64, like server-icon.png) into the data URI
+// form used by status responses.
+func loadFavicon(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	c, err := png.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	if c.Width != 64 || c.Height != 64 {
+		log.Printf("status.favicon: %s is %dx%d, clients expect 64x64", path, c.Width, c.Height)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// status is a backend status response with the ping round-trip time.
+type status struct {
+	json string
+	rtt  time.Duration
+	// protocol is the one the backend was asked with
+	protocol int32
+}
+
+type statusVersion struct {
+	Name     string `json:"name"`
+	Protocol int32  `json:"protocol"`
+}
+
+type statusPlayers struct {
+	Max    int `json:"max"`
+	Online int `json:"online"`
+}
+
+type statusDoc struct {
+	Version     statusVersion   `json:"version"`
+	Players     statusPlayers   `json:"players"`
+	Description json.RawMessage `json:"description"`
+	Favicon     string          `json:"favicon,omitempty"`
+}
+
+// syntheticStatus builds a status response served without the backend.
+// Protocol -1 makes clients show the version string instead of a player
+// count.
+func (cfg *Config) syntheticStatus(motd, ver string) string {
+	d := statusDoc{
+		Version:     statusVersion{Name: ver, Protocol: -1},
+		Description: json.RawMessage(chatJSON(cfg.renderMOTD(motd, statusDoc{}, 0))),
+		Favicon:     cfg.Status.favicon,
+	}
+	b, _ := json.Marshal(d)
+	return string(b)
+}
+
+// offlineStatus is served when the backend cannot be reached.
+func (cfg *Config) offlineStatus() string {
+	return cfg.syntheticStatus(cfg.Status.OfflineMOTD, cfg.Status.OfflineVersion)
+}
+
+func (cfg *Config) renderMOTD(tmpl string, d statusDoc, rtt time.Duration) string {
+	return strings.NewReplacer(
+		"{online}", strconv.Itoa(d.Players.Online),
+		"{max}", strconv.Itoa(d.Players.Max),
+		"{version}", d.Version.Name,
+		"{backend_latency}", strconv.FormatInt(rtt.Milliseconds(), 10),
+		"{proxy_version}", version,
+		"{connections}", strconv.FormatInt(atomic.LoadInt64(&activeTCP), 10),
+	).Replace(tmpl)
+}
+
+// localStatus applies the configured MOTD template and favicon to a
+// backend response.
+func (cfg *Config) localStatus(st status, cliAddr net.Addr) string {
+	motd := cfg.Status.motdFor(cliAddr)
+	if motd == "" && cfg.Status.favicon == "" {
+		return st.json
+	}
+	var doc statusDoc
+	var m map[string]json.RawMessage
+	if json.Unmarshal([]byte(st.json), &doc) != nil || json.Unmarshal([]byte(st.json), &m) != nil {
+		return st.json
+	}
+	if motd != "" {
+		m["description"] = json.RawMessage(chatJSON(cfg.renderMOTD(motd, doc, st.rtt)))
+	}
+	if cfg.Status.favicon != "" && (cfg.Status.FaviconMode == "replace" || doc.Favicon == "") {
+		m["favicon"], _ = json.Marshal(cfg.Status.favicon)
+	}
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+type statusEntry struct {
+	st      status
+	expires time.Time
+	err     error
+	ready   chan struct{}
+}
+
+// statusCache holds backend status responses; concurrent misses for the
+// same key share a single backend query.
+type statusCache struct {
+	mu sync.Mutex
+	m  map[string]*statusEntry
+}
+
+var statuses = newStatusCache()
+
+func newStatusCache() *statusCache {
+	c := &statusCache{m: make(map[string]*statusEntry)}
+	go c.sweep()
+	return c
+}
+
+// sweep drops the expired entries, so that backends which left the config
+// do not stay in memory.
+func (c *statusCache) sweep() {
+	for {
+		time.Sleep(time.Minute)
+		c.mu.Lock()
+		for key, e := range c.m {
+			select {
+			case <-e.ready:
+				if time.Now().After(e.expires) {
+					delete(c.m, key)
+				}
+			default:
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *statusCache) get(key string, ttl time.Duration, fetch func() (status, error)) (status, error) {
+	c.mu.Lock()
+	if e := c.m[key]; e != nil {
+		select {
+		case <-e.ready:
+			if e.err == nil && time.Now().Before(e.expires) {
+				c.mu.Unlock()
+				return e.st, nil
+			}
+		default:
+			c.mu.Unlock()
+			<-e.ready
+			return e.st, e.err
+		}
+	}
+	e := &statusEntry{ready: make(chan struct{})}
+	c.m[key] = e
+	c.mu.Unlock()
+
+	e.st, e.err = fetch()
+	e.expires = time.Now().Add(ttl)
+	close(e.ready)
+	return e.st, e.err
+}
+
+// queryStatus performs a server list ping against the backend on its own
+// connection and returns the status JSON and the ping round-trip time.
+func queryStatus(cfg *Config, addr string, hs handshake, cliAddr net.Addr, timeout time.Duration) (string, time.Duration, error) {
+	deadline := time.Now().Add(timeout)
+	backend, err := connectBackend(cfg, addr, cliAddr, timeout)
+	if err != nil {
+		return "", 0, err
+	}
+	defer backend.Close()
+	backend.SetDeadline(deadline)
+
+	hs.NextState = stateStatus
+	if _, err := backend.Write(append(hs.encode(), framePacket(0x00, nil)...)); err != nil {
+		return "", 0, err
+	}
+	br := bufio.NewReader(backend)
+	id, body, _, err := readPacket(br, maxStatusLen)
+	if err != nil {
+		return "", 0, err
+	}
+	p := &packetReader{b: body}
+	json := p.string(maxStatusLen)
+	if id != 0x00 || p.err != nil {
+		return "", 0, fmt.Errorf("bad status response")
+	}
+
+	start := time.Now()
+	payload := binary.BigEndian.AppendUint64(nil, uint64(start.UnixMilli()))
+	if _, err := backend.Write(framePacket(0x01, payload)); err != nil {
+		return json, 0, nil
+	}
+	if id, _, _, err := readPacket(br, 64); err != nil || id != 0x01 {
+		return json, 0, nil
+	}
+	return json, time.Since(start), nil
+}
+
+// relayStatus forwards a status exchange packet by packet so the
+// ping/pong round trip to the backend can be measured.
+func relayStatus(client net.Conn, br *bufio.Reader, backend net.Conn) (time.Duration, error) {
+	bbr := bufio.NewReader(backend)
+	deadline := time.Now().Add(handshakeTimeout)
+	client.SetReadDeadline(deadline)
+	backend.SetReadDeadline(deadline)
+
+	var start time.Time
+	for i, src := range []*bufio.Reader{br, bbr, br, bbr} {
+		dst := backend
+		if src == bbr {
+			dst = client
+		}
+		_, _, raw, err := readPacket(src, maxStatusLen)
+		if err != nil {
+			return 0, err
+		}
+		if i == 2 {
+			start = time.Now()
+		}
+		if _, err := dst.Write(raw); err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start), nil
+}
+
+// serveStatus answers the client's status request and ping locally.
+func serveStatus(client net.Conn, br *bufio.Reader, json string) error {
+	client.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	id, _, _, err := readPacket(br, 64)
+	if err != nil {
+		return err
+	}
+	if id != 0x00 {
+		return fmt.Errorf("unexpected packet 0x%02x in status", id)
+	}
+	if _, err := client.Write(framePacket(0x00, appendString(nil, json))); err != nil {
+		return err
+	}
+	id, body, _, err := readPacket(br, 64)
+	if err != nil || id != 0x01 {
+		return nil
+	}
+	_, err = client.Write(framePacket(0x01, body))
+	return err
+}
+
+func (cfg *Config) cachedStatus(addr string, hs handshake, cliAddr net.Addr) (status, error) {
+	if addr == "" {
+		return status{}, errNoServers
+	}
+	if !backendHealthy(addr) {
+		return status{}, errBackendDown
+	}
+	ttl := time.Duration(cfg.Status.CacheTTLSeconds) * time.Second
+	// one entry per backend: the protocol is the client's choice, and a key
+	// on it would let every ping with a new one through to the backend
+	st, err := statuses.get(addr, ttl, func() (status, error) {
+		if !cfg.circuitAttempt(addr) {
+			return status{}, errBackendDown
+		}
+		json, rtt, err := queryStatus(cfg, addr, hs, cliAddr, handshakeTimeout)
+		cfg.recordDial(addr, err)
+		recordLatency(addr, rtt)
+		return status{json, rtt, hs.Protocol}, err
+	})
+	if err == nil {
+		st.json = st.forProtocol(hs.Protocol)
+	}
+	return st, err
+}
+
+// forProtocol adapts a cached response to a client of another protocol. A
+// backend that answers with the protocol it was asked with (ViaVersion and
+// the like) would answer this client with its protocol too; one that
+// reports its own version is left as it is.
+func (st status) forProtocol(p int32) string {
+	if p == st.protocol {
+		return st.json
+	}
+	var doc statusDoc
+	var m map[string]json.RawMessage
+	if json.Unmarshal([]byte(st.json), &doc) != nil || json.Unmarshal([]byte(st.json), &m) != nil ||
+		doc.Version.Protocol != st.protocol {
+		return st.json
+	}
+	doc.Version.Protocol = p
+	m["version"], _ = json.Marshal(doc.Version)
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+// serveStatusOnly handles a connection on a status-only listener: pings get
+// the cached backend status when caching is on and the backend answers,
+// otherwise a status built from the config; logins are refused.
+func (cfg *Config) serveStatusOnly(l *Listener, client net.Conn, br *bufio.Reader, h *clientHello, cliAddr net.Addr) {
+	if h.hs.NextState == stateLogin {
+		cfg.logf("%s: login %q refused: status-only listener", cliAddr, h.login.Name)
+		client.Write(loginDisconnect(l.LoginKick))
+		return
+	}
+	if p, ok := cfg.route(l, h); ok && cfg.Status.CacheTTLSeconds > 0 {
+		if st, err := cfg.cachedStatus(p.split().pick(cliAddr, nil), h.hs, cliAddr); err == nil {
+			serveStatus(client, br, cfg.localStatus(st, cliAddr))
+			return
+		}
+	}
+	motd := cfg.Status.motdFor(cliAddr)
+	if motd == "" {
+		motd = cfg.Status.OfflineMOTD
+	}
+	serveStatus(client, br, cfg.syntheticStatus(motd, cfg.Status.OfflineVersion))
+}
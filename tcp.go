@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// needHello reports whether the client's opening packets must be decoded
+// before the backend is chosen and dialed.
+func (cfg *Config) needHello(l *Listener) bool {
+	return cfg.Backend.Forwarding != "none" || len(cfg.VHosts) > 0 || cfg.LegacyPing.Mode != "forward" ||
+		cfg.Limits.status != nil || cfg.Limits.login != nil || cfg.Limits.loginIP != nil || len(l.protocols) > 0 ||
+		cfg.Status.local() || cfg.Status.OfflineMOTD != "" || cfg.Backend.Unreachable != "" ||
+		maintenance.Load() || cfg.Status.TrackLatency || cfg.Honeypot.Enabled ||
+		l.Mode == "status" || cfg.Backend.Fallback != "" || len(cfg.Rules) > 0 || cfg.Reputation.enabled() ||
+		cfg.Usernames.enabled() || l.HelloTimeoutMs > 0 || l.HelloMinRate > 0 || cfg.Framing.Enabled ||
+		l.Validate != "off"
+}
+
+// admit counts the connection by its next state and applies the per-state
+// rate limit.
+func (cfg *Config) admit(l *Listener, client net.Conn, h *clientHello, cliAddr net.Addr) bool {
+	switch h.hs.NextState {
+	case stateStatus:
+		atomic.AddInt64(&statusPings, 1)
+		if !cfg.Limits.status.allow() {
+			atomic.AddInt64(&statusLimited, 1)
+			return false
+		}
+	case stateLogin:
+		atomic.AddInt64(&loginAttempts, 1)
+		if !protoAllowed(l.protocols, h.hs.Protocol) {
+			atomic.AddInt64(&protocolRejected, 1)
+			cfg.logf("%s: login %q with unsupported protocol %d", cliAddr, h.login.Name, h.hs.Protocol)
+			l.securityEvent("kick", "protocol", sourceIP(cliAddr), h.login.Name)
+			client.Write(loginDisconnect(l.ProtocolKick))
+			return false
+		}
+		if !cfg.Limits.login.allow() {
+			atomic.AddInt64(&loginLimited, 1)
+			cfg.logf("%s: login %q rate limited", cliAddr, h.login.Name)
+			client.Write(loginDisconnect(cfg.Limits.LoginLimitMessage))
+			return false
+		}
+		if !cfg.Limits.loginIP.take(sourceIP(cliAddr)) {
+			atomic.AddInt64(&loginIPLimited, 1)
+			cfg.logf("%s: login %q throttled", cliAddr, h.login.Name)
+			l.securityEvent("ratelimit", "login_ip", sourceIP(cliAddr), h.login.Name)
+			client.Write(loginDisconnect(cfg.Limits.LoginIPMessage))
+			return false
+		}
+		if !cfg.Usernames.allowed(h.login) {
+			atomic.AddInt64(&nameDenied, 1)
+			cfg.logf("%s: login %q refused: username not allowed", cliAddr, h.login.Name)
+			l.securityEvent("kick", "username", sourceIP(cliAddr), h.login.Name)
+			client.Write(loginDisconnect(cfg.Usernames.KickMessage))
+			return false
+		}
+		if fml := fmlMarker(h.hs.Host); fml != "" {
+			cfg.logf("%s: login %q via %q (protocol %d, %s)", cliAddr, h.login.Name, normalizeHost(h.hs.Host), h.hs.Protocol, fml)
+		} else {
+			cfg.logf("%s: login %q via %q (protocol %d)", cliAddr, h.login.Name, normalizeHost(h.hs.Host), h.hs.Protocol)
+		}
+	}
+	return true
+}
+
+func (cfg *Config) unreachableMessage(h *clientHello) string {
+	return strings.NewReplacer(
+		"{player}", h.login.Name,
+		"{host}", normalizeHost(h.hs.Host),
+		"{retry}", strconv.Itoa(cfg.Backend.RetrySecs),
+	).Replace(cfg.Backend.Unreachable)
+}
+
+func handleTCP(client net.Conn, cfg *Config, l *Listener) {
+	atomic.AddInt64(&activeTCP, 1)
+	defer func() {
+		client.Close()
+		atomic.AddInt64(&activeTCP, -1)
+	}()
+
+	full := !l.take()
+	if !full {
+		defer l.release()
+	}
+
+	br := bufio.NewReader(client)
+	var guard *helloGuard
+	if l.HelloTimeoutMs > 0 || l.HelloMinRate > 0 {
+		guard = l.guardHello(client)
+		defer guard.done()
+		br = bufio.NewReader(guard)
+	}
+	cliAddr := client.RemoteAddr()
+	if !l.awaitFirstByte(client, br) {
+		atomic.AddInt64(&silentDropped, 1)
+		if !l.trusts(cliAddr) {
+			l.securityEvent("deny", "silent", sourceIP(cliAddr), "")
+		}
+		return
+	}
+	if l.trusts(cliAddr) {
+		client.SetReadDeadline(time.Now().Add(handshakeTimeout))
+		src, err := readProxyHeader(br)
+		if err != nil {
+			cfg.logf("%s: inbound proxy header: %v", cliAddr, err)
+			return
+		}
+		if src != nil {
+			cliAddr = src
+		}
+		if !l.sourceAllowed(sourceIP(cliAddr)) {
+			return
+		}
+	}
+	if !cfg.Limits.admitTCP(sourceIP(cliAddr)) {
+		l.securityEvent("ratelimit", "subnet", sourceIP(cliAddr), "")
+		return
+	}
+	defer cfg.Limits.releaseTCP(sourceIP(cliAddr))
+	if full {
+		cfg.refuseFull(l, client, br, cliAddr)
+		return
+	}
+
+	var pending []byte
+	var hello *clientHello
+	var rule *Rule
+	if cfg.needHello(l) {
+		client.SetReadDeadline(time.Now().Add(handshakeTimeout))
+		h, err := readHello(br)
+		if err == nil && l.Validate == "request" && !h.legacy && h.hs.NextState == stateStatus {
+			err = awaitStatusRequest(br)
+		}
+		if guard != nil && (!guard.done() || guard.tripped()) {
+			atomic.AddInt64(&slowDropped, 1)
+			l.securityEvent("deny", "slow", sourceIP(cliAddr), "")
+			cfg.logf("%s: handshake: too slow", cliAddr)
+			return
+		}
+		if err != nil {
+			atomic.AddInt64(&invalidDropped, 1)
+			l.securityEvent("deny", "invalid", sourceIP(cliAddr), "")
+			cfg.logf("%s: handshake: %v", cliAddr, err)
+			return
+		}
+		if cfg.Framing.Enabled && !h.legacy {
+			if err := cfg.Framing.checkHello(h); err != nil {
+				cfg.refuseFraming(l, cliAddr, err)
+				return
+			}
+		}
+		hello = h
+		rule = cfg.ruleFor(l, cliAddr, h)
+		switch {
+		case rule.refuses():
+			cfg.refuseRule(l, client, h, cliAddr, rule)
+			return
+		case h.legacy && cfg.LegacyPing.Mode == "local":
+			client.Write(cfg.LegacyPing.pong(br))
+			return
+		case h.legacy && cfg.LegacyPing.Mode == "close":
+			return
+		case h.legacy:
+		case !cfg.admit(l, client, h, cliAddr):
+			return
+		case cfg.Reputation.enabled() && h.hs.NextState == stateLogin && !cfg.admitLogin(l, client, h, cliAddr):
+			return
+		case l.Mode == "status":
+			cfg.serveStatusOnly(l, client, br, h, cliAddr)
+			return
+		case cfg.Honeypot.Enabled && scanners.observe(&cfg.Honeypot, cliAddr, h.hs.NextState):
+			atomic.AddInt64(&scannerHits, 1)
+			l.securityEvent("deny", "scanner", sourceIP(cliAddr), "")
+			logScanner(cliAddr, h.hs)
+			serveStatus(client, br, cfg.Honeypot.decoyStatus(h.hs))
+			return
+		case maintenance.Load() && !cfg.Maintenance.bypass(h, cliAddr):
+			if h.hs.NextState == stateStatus {
+				serveStatus(client, br, cfg.syntheticStatus(cfg.Maintenance.MOTD, cfg.Maintenance.Version))
+			} else {
+				cfg.logf("%s: login %q refused: maintenance", cliAddr, h.login.Name)
+				client.Write(loginDisconnect(cfg.Maintenance.KickMessage))
+			}
+			return
+		case h.hs.NextState == stateLogin && cfg.Backend.Forwarding != "none" && !forwardable(cliAddr):
+			cfg.logf("%s: login %q refused: no client IP to forward", cliAddr, h.login.Name)
+			return
+		case cfg.Backend.Forwarding == "bungeecord":
+			pending = bungeeRewrite(h, cliAddr)
+		default:
+			pending = h.raw()
+		}
+	}
+	client.SetReadDeadline(time.Time{})
+	relay := hello != nil && !hello.legacy && hello.hs.NextState == stateStatus && cfg.Status.TrackLatency
+	var src io.Reader = client
+	var frames *frameCheck
+	if !relay {
+		buffered, _ := br.Peek(br.Buffered())
+		if cfg.Framing.Enabled && hello != nil && !hello.legacy {
+			frames = cfg.Framing.newFrameCheck(client, hello.hs)
+			if err := frames.check(buffered); err != nil {
+				cfg.refuseFraming(l, cliAddr, err)
+				return
+			}
+			src = frames
+		}
+		pending = append(pending, buffered...)
+	}
+
+	pool, ok := cfg.route(l, hello)
+	if rule != nil && rule.pool != nil {
+		pool, ok = rule.pool, true
+	}
+	if !ok {
+		cfg.logf("%s: unknown host %q", cliAddr, hello.hs.Host)
+		if cfg.Routing.Unknown == "kick" && hello.hs.NextState == stateLogin {
+			client.Write(loginDisconnect(cfg.Routing.KickMessage))
+		}
+		return
+	}
+	login := hello != nil && !hello.legacy && hello.hs.NextState == stateLogin
+	fallback := cfg.fallbackFor(pool)
+	pool = pool.split()
+	backendAddr := pool.pick(cliAddr, nil)
+
+	if hello != nil && !hello.legacy && hello.hs.NextState == stateStatus && cfg.Status.local() {
+		st, err := cfg.cachedStatus(backendAddr, hello.hs, cliAddr)
+		json := cfg.localStatus(st, cliAddr)
+		if err != nil {
+			cfg.logf("%s: status: %v", cliAddr, err)
+			if cfg.Status.OfflineMOTD == "" {
+				return
+			}
+			json = cfg.offlineStatus()
+		}
+		serveStatus(client, br, json)
+		return
+	}
+
+	backend, backendAddr, err := cfg.dialPool(pool, backendAddr, cliAddr)
+	if err != nil && login && fallback != nil {
+		cfg.logf("%s: dial backend: %v; sending to fallback %s", cliAddr, err, fallback.Name)
+		backend, backendAddr, err = cfg.dialPool(fallback, fallback.pick(cliAddr, nil), cliAddr)
+		fallback = nil
+	}
+	if err != nil {
+		cfg.logf("%s: dial backend: %v", cliAddr, err)
+		switch {
+		case hello == nil || hello.legacy:
+		case hello.hs.NextState == stateStatus && cfg.Status.OfflineMOTD != "":
+			serveStatus(client, br, cfg.offlineStatus())
+		case hello.hs.NextState == stateLogin && cfg.Backend.Unreachable != "":
+			client.Write(loginDisconnect(cfg.unreachableMessage(hello)))
+		}
+		return
+	}
+	st := stateOf(backendAddr)
+	st.active.Add(1)
+	defer func() {
+		backend.Close()
+		st.active.Add(-1)
+	}()
+
+	if len(pending) > 0 {
+		if _, err = backend.Write(pending); err != nil {
+			cfg.recordDial(backendAddr, err)
+			cfg.logf("%s: write backend: %v", cliAddr, err)
+			return
+		}
+	}
+	// what the backend sends a login client tells frames about compression
+	var down io.Writer = client
+	if frames != nil && login {
+		down = frames.watch(client)
+	}
+	if login && fallback != nil && cfg.Backend.Forwarding != "velocity" {
+		first, ok := firstRead(backend)
+		if !ok {
+			cfg.logf("%s: backend %s closed the login; sending to fallback %s", cliAddr, backendAddr, fallback.Name)
+			c, addr, err := cfg.redial(fallback, cliAddr, pending)
+			if err != nil {
+				cfg.logf("%s: dial fallback: %v", cliAddr, err)
+				if cfg.Backend.Unreachable != "" {
+					client.Write(loginDisconnect(cfg.unreachableMessage(hello)))
+				}
+				return
+			}
+			backend.Close()
+			st.active.Add(-1)
+			backend, backendAddr, st = c, addr, stateOf(addr)
+			st.active.Add(1)
+		} else if _, err := down.Write(first); err != nil {
+			return
+		}
+	}
+	if relay {
+		rtt, err := relayStatus(client, br, backend)
+		if err != nil {
+			cfg.logf("%s: status: %v", cliAddr, err)
+			return
+		}
+		recordLatency(backendAddr, rtt)
+		return
+	}
+	if cfg.Backend.Forwarding == "velocity" && login {
+		if err := velocityForward(down, backend, hello, cliAddr, cfg.Backend.secret); err != nil {
+			cfg.logf("%s: velocity forwarding: %v", cliAddr, err)
+			return
+		}
+	}
+
+	var up io.Writer = backend
+	if cfg.Backend.Mirror != "" && (hello == nil || login) {
+		m := cfg.openMirror(cliAddr, pending)
+		defer m.Close()
+		up = io.MultiWriter(backend, m)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { io.Copy(up, src); backend.SetDeadline(time.Now()); wg.Done() }()
+	go func() { io.Copy(down, backend); client.SetDeadline(time.Now()); wg.Done() }()
+	wg.Wait()
+	if frames != nil && frames.err != nil {
+		cfg.refuseFraming(l, cliAddr, frames.err)
+	}
+}
+
+// refuseFraming counts and logs a client dropped for breaking the framing
+// rules.
+func (cfg *Config) refuseFraming(l *Listener, cliAddr net.Addr, err error) {
+	atomic.AddInt64(&framingDropped, 1)
+	l.securityEvent("deny", "framing", sourceIP(cliAddr), "")
+	cfg.logf("%s: framing: %v", cliAddr, err)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+type BackendTLS struct {
+	CA         string `toml:"ca"`
+	Cert       string `toml:"cert"`
+	Key        string `toml:"key"`
+	ServerName string `toml:"server_name"`
+	Insecure   bool   `toml:"insecure_skip_verify"`
+
+	conf *tls.Config
+}
+
+func (t *BackendTLS) init() error {
+	t.conf = &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: t.Insecure}
+	if t.CA != "" {
+		pem, err := os.ReadFile(t.CA)
+		if err != nil {
+			return err
+		}
+		t.conf.RootCAs = x509.NewCertPool()
+		if !t.conf.RootCAs.AppendCertsFromPEM(pem) {
+			return errors.New("ca: no certificates found")
+		}
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		return errors.New("cert and key must be set together")
+	}
+	if t.Cert != "" {
+		crt, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return err
+		}
+		t.conf.Certificates = []tls.Certificate{crt}
+	}
+	return nil
+}
+
+// client runs the TLS handshake for a "tls://host:port" backend, checking
+// the certificate against server_name or, by default, the backend host.
+func (t *BackendTLS) client(c net.Conn, addr string) (net.Conn, error) {
+	conf := t.conf.Clone()
+	conf.ServerName = t.ServerName
+	if conf.ServerName == "" {
+		conf.ServerName, _, _ = net.SplitHostPort(strings.TrimPrefix(addr, "tls://"))
+	}
+	tc := tls.Client(c, conf)
+	tc.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import "syscall"
+
+const (
+	ipv6Transparent = 0x4b
+
+	transparentSupported = true
+)
+
+// transparentControl sets IP_TRANSPARENT so the backend socket can bind to
+// the client's (non-local) address.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp6" || network == "udp6" {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+			return
+		}
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const transparentSupported = false
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return errors.New("transparent mode is only supported on linux")
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+type assoc struct {
+	cliAddr *net.UDPAddr
+	ip      netip.Addr
+	backend *net.UDPConn
+	seen    atomic.Int64 // unix nanoseconds of the last client datagram
+	created int64
+	hdr     []byte
+	target  string
+	routed  bool // target chosen by a route rule, which failover leaves alone
+	session atomic.Int32
+
+	upPackets, upBytes     atomic.Int64 // client to backend
+	downPackets, downBytes atomic.Int64 // backend to client
+}
+
+// expiry is when the association lapses unless the client sends more.
+func (a *assoc) expiry(idle, lifetime time.Duration) time.Time {
+	t := time.Unix(0, a.seen.Load()).Add(idle)
+	if lifetime > 0 {
+		if end := time.Unix(0, a.created).Add(lifetime); end.Before(t) {
+			t = end
+		}
+	}
+	return t
+}
+
+func (a *assoc) countUp(n int) {
+	a.upPackets.Add(1)
+	a.upBytes.Add(int64(n))
+	atomic.AddInt64(&udpPacketsUp, 1)
+	atomic.AddInt64(&udpBytesUp, int64(n))
+}
+
+func (a *assoc) countDown(packets, n int) {
+	a.downPackets.Add(int64(packets))
+	a.downBytes.Add(int64(n))
+	atomic.AddInt64(&udpPacketsDown, int64(packets))
+	atomic.AddInt64(&udpBytesDown, int64(n))
+}
+
+// RakNet progress of an association: a client that asked to open a
+// connection becomes a player once the backend accepts it.
+const (
+	sessionNone = iota
+	sessionOpening
+	sessionPlayer
+	sessionClosed
+)
+
+// accept counts the association as a player if it was opening a session.
+func (a *assoc) accept() bool {
+	atomic.AddInt64(&bedrockPlayers, 1)
+	if a.session.CompareAndSwap(sessionOpening, sessionPlayer) {
+		return true
+	}
+	atomic.AddInt64(&bedrockPlayers, -1)
+	return false
+}
+
+// close ends the session, if any, for good.
+func (a *assoc) close() {
+	if a.session.Swap(sessionClosed) == sessionPlayer {
+		atomic.AddInt64(&bedrockPlayers, -1)
+	}
+}
+
+// Bounds of listen.datagram_size: RakNet never goes below its minimum MTU
+// of 576 bytes, and no UDP payload exceeds 65507 bytes over IPv4.
+const (
+	minDatagramSize = 576
+	maxDatagramSize = 65507
+)
+
+func udpForward(cfg *Config, l *Listener, pc net.PacketConn) {
+	idle := time.Duration(cfg.IdleTimeoutSeconds) * time.Second
+	lifetime := time.Duration(l.UDPLifetime) * time.Second
+	defer pc.Close()
+
+	for _, b := range l.Backends {
+		if _, err := net.ResolveUDPAddr("udp", dialAddr(b)); err != nil {
+			log.Fatalf("resolve backend: %v", err)
+		}
+	}
+
+	assocs := newAssocTable()
+	udpTables.Store(assocs, l.Name)
+	defer udpTables.Delete(assocs)
+	drop := func(a *assoc) {
+		a.backend.Close()
+		a.close()
+		atomic.AddInt64(&activeUDP, -1)
+		releaseUDP(a.ip)
+		l.release()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(time.Duration(l.UDPSweepSecs) * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				assocs.sweep(idle, lifetime, drop)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var gate *raknetGate
+	if cfg.Bedrock.Cookie {
+		g, err := cfg.newRaknetGate(l)
+		if err != nil {
+			log.Fatalf("bedrock.cookie: %v", err)
+		}
+		defer g.probe.Close()
+		go cfg.relayPongs(g, pc, l.DatagramSize)
+		gate = g
+	}
+
+	workers := newUDPWorkers(l.UDPWorkers, l.UDPQueue, l.DatagramSize, func(j udpJob) {
+		a, buf := j.a, (*j.buf)[:j.n]
+		var err error
+		if a.hdr != nil {
+			_, err = a.backend.Write(append(a.hdr[:len(a.hdr):len(a.hdr)], buf...))
+		} else {
+			_, err = a.backend.Write(buf)
+		}
+		if err == nil {
+			a.countUp(len(buf))
+		} else if !errors.Is(err, net.ErrClosed) {
+			// usually ICMP port unreachable: the next datagram opens a new
+			// association, to another backend once this one is marked down
+			cfg.logf("%s: udp backend %s: %v", a.cliAddr, a.target, err)
+			cfg.recordDial(udpStateKey(a.target), err)
+			if assocs.remove(j.key, a) {
+				drop(a)
+			}
+			return
+		}
+		if a.session.Load() == sessionPlayer && raknetDisconnected(buf) {
+			cfg.logf("%s: bedrock session closed by the client", a.cliAddr)
+			if assocs.remove(j.key, a) {
+				drop(a)
+			}
+		}
+	})
+	defer workers.stop()
+
+	if c, ok := pc.(net.Conn); ok {
+		cfg.Listen.Socket.setDSCP(c)
+	}
+	bc := newBatchConn(pc)
+	// one byte more than datagram_size, so that larger datagrams show
+	msgs := newMessages(udpBatch, l.DatagramSize+1)
+	for {
+		n, err := bc.ReadBatch(msgs, 0)
+		if errors.Is(err, net.ErrClosed) {
+			assocs.sweep(-1, 0, drop)
+			return
+		}
+		if err != nil {
+			log.Printf("udp read: %v", err)
+			continue
+		}
+
+		now := time.Now().UnixNano()
+		for _, m := range msgs[:n] {
+			addr, buf := m.Addr.(*net.UDPAddr), m.Buffers[0][:m.N]
+			key := addr.AddrPort()
+			ip := key.Addr().Unmap()
+			if len(buf) == 0 || len(buf) > l.DatagramSize {
+				atomic.AddInt64(&udpMalformed, 1)
+				continue
+			}
+			if !cfg.Limits.allowUDP(ip, len(buf)) {
+				continue
+			}
+			if cfg.Query.Enabled && isQuery(buf) {
+				if l.sourceAllowed(ip) {
+					cfg.answerQuery(pc, buf, addr)
+				}
+				continue
+			}
+			if cfg.Bedrock.Validate && !raknetValid(buf) {
+				atomic.AddInt64(&udpMalformed, 1)
+				continue
+			}
+			// only this loop adds associations, so a miss stays a miss
+			// until the put below
+			a := assocs.get(key)
+			// a failed-over client goes through the same checks as a
+			// new one below
+			if a != nil && !a.routed && !backendHealthy(udpStateKey(a.target)) {
+				if t := l.udpBackend(addr); t != a.target {
+					cfg.logf("%s: udp backend %s is down, moving to %s", addr, a.target, t)
+					if assocs.remove(key, a) {
+						drop(a)
+					}
+					a = nil
+				}
+			}
+			if a == nil && !l.sourceAllowed(ip) {
+				continue
+			}
+			var rule *Rule
+			if a == nil && len(cfg.Rules) > 0 {
+				if rule = cfg.ruleFor(l, addr, nil); rule.refuses() {
+					atomic.AddInt64(&ruleDenied, 1)
+					continue
+				}
+			}
+			if a == nil && gate == nil && cfg.Reputation.enabled() && raknetOpenRequest(buf) && !cfg.Reputation.admitUDP(ip) {
+				continue
+			}
+			if gate != nil {
+				switch {
+				case len(buf) > 0 && buf[0] == raknetOpenConnectionRequest1 && raknetOpenRequest(buf):
+					pc.WriteTo(gate.reply1(buf, key), addr)
+					continue
+				case len(buf) > 0 && buf[0] == raknetOpenConnectionRequest2:
+					b, ok := gate.open(buf, key)
+					if !ok {
+						atomic.AddInt64(&cookieRejected, 1)
+						continue
+					}
+					if a == nil && cfg.Reputation.enabled() && !cfg.Reputation.admitUDP(ip) {
+						continue
+					}
+					buf = b
+				case a == nil && raknetPing(buf):
+					gate.ping(pc, buf, addr)
+					continue
+				case a == nil:
+					atomic.AddInt64(&cookieRejected, 1)
+					continue
+				}
+			}
+			if a == nil {
+				if limit := cfg.Limits.admitUDP(ip); limit != "" {
+					cfg.logUDPDrop(addr, limit)
+					continue
+				}
+				if !l.take() {
+					atomic.AddInt64(&fullRejected, 1)
+					releaseUDP(ip)
+					continue
+				}
+				target := l.udpBackend(addr)
+				if rule != nil && rule.Action == "route" {
+					target = rule.Backend
+				}
+				// the read loop must not wait for DNS: a backend still
+				// being resolved drops the datagram, and the client retries
+				raddr, err := udpBackendAddr(target, false)
+				var c *net.UDPConn
+				if err == nil {
+					c, err = cfg.openUDP(raddr)
+				}
+				if err != nil {
+					l.release()
+					releaseUDP(ip)
+					cfg.logf("dial udp backend: %v", err)
+					continue
+				}
+				a = &assoc{cliAddr: addr, ip: ip, backend: c, created: now, target: target, routed: rule != nil && rule.Action == "route"}
+				a.seen.Store(now)
+				if cfg.Backend.SendProxyUDP == "v2" {
+					a.hdr = proxyV2(a.cliAddr, c.LocalAddr(), cfg.Backend.ProxyTLVs)
+				}
+				assocs.put(key, a)
+				atomic.AddInt64(&activeUDP, 1)
+				go cfg.udpReturn(l, bc, a, func() {
+					if assocs.remove(key, a) {
+						drop(a)
+					}
+				})
+			}
+			a.seen.Store(now)
+			if raknetOpenRequest(buf) {
+				a.session.CompareAndSwap(sessionNone, sessionOpening)
+			}
+			if !workers.submit(key, a, buf) {
+				atomic.AddInt64(&udpQueueDropped, 1)
+			}
+		}
+	}
+}
+
+// udpPortNext is where the search for a free port of
+// backend.udp_source_ports starts, so that ports are reused last.
+var udpPortNext atomic.Int64
+
+// dialUDP resolves a UDP backend, waiting for the lookup if it has to,
+// and opens a socket to it.
+func (cfg *Config) dialUDP(target string) (*net.UDPConn, error) {
+	raddr, err := udpBackendAddr(target, true)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.openUDP(raddr)
+}
+
+// openUDP opens an association's socket to a backend, from
+// backend.bind_address and a port of backend.udp_source_ports when set.
+func (cfg *Config) openUDP(raddr *net.UDPAddr) (*net.UDPConn, error) {
+	lo, hi := cfg.Backend.udpPorts[0], cfg.Backend.udpPorts[1]
+	if lo == 0 {
+		c, err := net.DialUDP("udp", &net.UDPAddr{IP: cfg.Backend.bind}, raddr)
+		if err == nil {
+			cfg.Backend.Socket.setDSCP(c)
+		}
+		return c, err
+	}
+	n := int64(hi - lo + 1)
+	for range n {
+		port := lo + int(udpPortNext.Add(1)%n)
+		c, err := net.DialUDP("udp", &net.UDPAddr{IP: cfg.Backend.bind, Port: port}, raddr)
+		if err == nil {
+			cfg.Backend.Socket.setDSCP(c)
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in backend.udp_source_ports %d-%d", lo, hi)
+}
+
+// udpReturn relays the backend's datagrams for one association back to
+// its client, a batch at a time, and calls end when the backend disconnects
+// the player, its socket fails or the association expires. The read
+// deadline follows the expiry, so a silent backend does not keep the
+// goroutine waiting for the sweep.
+func (cfg *Config) udpReturn(l *Listener, pc batchConn, a *assoc, end func()) {
+	idle := time.Duration(cfg.IdleTimeoutSeconds) * time.Second
+	lifetime := time.Duration(l.UDPLifetime) * time.Second
+	in := newMessages(udpBackendBatch, l.DatagramSize)
+	out := make([]ipv4.Message, udpBackendBatch)
+	bc := newBatchConn(a.backend)
+	for {
+		if idle > 0 {
+			a.backend.SetReadDeadline(a.expiry(idle, lifetime))
+		}
+		n, err := bc.ReadBatch(in, 0)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if time.Now().After(a.expiry(idle, lifetime)) {
+				end()
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				cfg.logf("%s: udp backend %s: %v", a.cliAddr, a.target, err)
+				cfg.recordDial(udpStateKey(a.target), err)
+				end()
+			}
+			return
+		}
+		if a.downPackets.Load() == 0 {
+			cfg.recordDial(udpStateKey(a.target), nil)
+		}
+		closed := false
+		size := 0
+		for i, m := range in[:n] {
+			b := m.Buffers[0][:m.N]
+			size += len(b)
+			switch {
+			case len(b) > 0 && b[0] == raknetUnconnectedPong:
+				recordPong(a.target, b)
+				if cfg.Bedrock.rewrites() {
+					b = cfg.rewritePong(b)
+				}
+			case raknetOpenReply(b):
+				if a.accept() {
+					cfg.logf("%s: bedrock session opened", a.cliAddr)
+				}
+			case a.session.Load() == sessionPlayer && raknetDisconnected(b):
+				closed = true
+			}
+			out[i] = ipv4.Message{Buffers: [][]byte{b}, Addr: a.cliAddr}
+		}
+		writeAll(pc, out[:n])
+		a.countDown(n, size)
+		if closed {
+			cfg.logf("%s: bedrock session closed by the backend", a.cliAddr)
+			end()
+			return
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Upgrade controls how the old process winds down after handing its
+// sockets to a new binary; 0 waits for every player to leave.
+type Upgrade struct {
+	DrainTimeoutSeconds int `toml:"drain_timeout_seconds"`
+}
+
+// upgradeReadyEnv names the descriptor a process started by upgrade writes
+// to once its listeners are up.
+const upgradeReadyEnv = "MCPROXY_UPGRADE_READY"
+
+// upgradeReadyTimeout bounds how long the old process waits for the new one.
+const upgradeReadyTimeout = 30 * time.Second
+
+var upgrading atomic.Bool
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// upgrade starts the current binary again with the listening sockets passed
+// the way systemd socket activation passes them. Once the new process is
+// listening, this one closes its copies, so new players land there, and
+// exits when its connections have drained. If the new process fails to come
+// up, nothing changes.
+func (cfg *Config) upgrade() error {
+	if !upgrading.CompareAndSwap(false, true) {
+		return errors.New("already in progress")
+	}
+	child, err := cfg.startUpgrade()
+	if err != nil {
+		upgrading.Store(false)
+		return err
+	}
+	notifySystemd(fmt.Sprintf("MAINPID=%d", child))
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		for _, ln := range l.lns {
+			if ul, ok := ln.(*net.UnixListener); ok {
+				// the socket file is the new process's now
+				ul.SetUnlinkOnClose(false)
+			}
+			ln.Close()
+		}
+		for _, pc := range l.pcs {
+			pc.Close()
+		}
+	}
+	if metricsListener != nil {
+		metricsListener.Close()
+	}
+	log.Printf("upgrade: pid %d took over, draining %d connections", child, atomic.LoadInt64(&activeTCP))
+	go cfg.drain()
+	return nil
+}
+
+func (cfg *Config) startUpgrade() (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	add := func(name string, s any) error {
+		f, err := s.(filer).File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		names = append(names, name)
+		return nil
+	}
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		for _, ln := range l.lns {
+			if err := add(l.Name, ln); err != nil {
+				return 0, err
+			}
+		}
+		for _, pc := range l.pcs {
+			if err := add(l.Name, pc); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if metricsListener != nil {
+		if err := add(metricsSocketName, metricsListener); err != nil {
+			return 0, err
+		}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "LISTEN_") && !strings.HasPrefix(e, upgradeReadyEnv+"=") {
+			cmd.Env = append(cmd.Env, e)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		upgradeReadyEnv+"="+strconv.Itoa(listenFdsStart+len(files)))
+	cfg.Affinity.save()
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+	go cmd.Wait()
+
+	// the pipe reads EOF if the new process exits before it is ready
+	r.SetReadDeadline(time.Now().Add(upgradeReadyTimeout))
+	var b [1]byte
+	if _, err := r.Read(b[:]); err != nil {
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("new process %d did not start: %v", cmd.Process.Pid, err)
+	}
+	return cmd.Process.Pid, nil
+}
+
+func (cfg *Config) upgradeCommand() {
+	log.Printf("upgrade requested")
+	if err := cfg.upgrade(); err != nil {
+		log.Printf("upgrade: %v", err)
+	}
+}
+
+// drain exits once the TCP connections are gone or the drain timeout runs
+// out. UDP associations cannot follow: the new process reads the shared
+// socket, so Bedrock players reconnect to it.
+func (cfg *Config) drain() {
+	var deadline <-chan time.Time
+	if s := cfg.Upgrade.DrainTimeoutSeconds; s > 0 {
+		deadline = time.After(time.Duration(s) * time.Second)
+	}
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for atomic.LoadInt64(&activeTCP) > 0 {
+		select {
+		case <-tick.C:
+		case <-deadline:
+			log.Printf("upgrade: drain timeout, closing %d connections", atomic.LoadInt64(&activeTCP))
+			os.Exit(0)
+		}
+	}
+	log.Printf("upgrade: drained, exiting")
+	os.Exit(0)
+}
+
+// upgradeReady tells the process that started this one that the listeners
+// are up.
+func upgradeReady() {
+	v := os.Getenv(upgradeReadyEnv)
+	if v == "" {
+		return
+	}
+	os.Unsetenv(upgradeReadyEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "upgrade")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// notifySystemd sends a message to systemd's notify socket, so that after
+// an upgrade the service follows the new process instead of stopping with
+// the old one. It needs NotifyAccess= in the unit.
+func notifySystemd(msg string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		log.Printf("systemd notify: %v", err)
+		return
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte(msg)); err != nil {
+		log.Printf("systemd notify: %v", err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals start an upgrade, as `systemctl reload` sends them.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// reloadSignals read the access lists again and reopen the security log.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+func parseUpstream(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "http":
+	default:
+		return nil, fmt.Errorf("unknown scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("%s: port is required", s)
+	}
+	return u, nil
+}
+
+// dialUpstream connects to addr through a SOCKS5 or HTTP CONNECT proxy.
+func dialUpstream(d *net.Dialer, u *url.URL, addr string) (net.Conn, error) {
+	c, err := d.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	if u.Scheme == "socks5" {
+		err = socks5Connect(c, u, addr)
+	} else {
+		err = httpConnect(c, u, addr)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("upstream %s: %v", u.Host, err)
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func socks5Connect(c net.Conn, u *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	methods := []byte{0x00}
+	if u.User != nil {
+		methods = []byte{0x02}
+	}
+	if _, err := c.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var rep [2]byte
+	if _, err := io.ReadFull(c, rep[:]); err != nil {
+		return err
+	}
+	switch {
+	case rep[0] != 0x05:
+		return errors.New("not a SOCKS5 proxy")
+	case rep[1] == 0x02 && u.User != nil:
+		user := u.User.Username()
+		pass, _ := u.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("credentials too long")
+		}
+		b := append([]byte{0x01, byte(len(user))}, user...)
+		b = append(append(b, byte(len(pass))), pass...)
+		if _, err := c.Write(b); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, rep[:]); err != nil {
+			return err
+		}
+		if rep[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	case rep[1] != 0x00:
+		return fmt.Errorf("no acceptable auth method (0x%02x)", rep[1])
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 0x01), ip4...)
+	} else {
+		req = append(append(req, 0x04), ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[1] != 0x00 {
+		return fmt.Errorf("connect failed (reply 0x%02x)", hdr[1])
+	}
+	var skip int
+	switch hdr[3] {
+	case 0x01:
+		skip = 4
+	case 0x04:
+		skip = 16
+	case 0x03:
+		var n [1]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("bad address type 0x%02x", hdr[3])
+	}
+	_, err = io.ReadFull(c, make([]byte, skip+2))
+	return err
+}
+
+func httpConnect(c net.Conn, u *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), pass)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(c); err != nil {
+		return err
+	}
+	// the backend does not speak before the client, so nothing past the
+	// response headers can be buffered here
+	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT: %s", resp.Status)
+	}
+	return nil
+}
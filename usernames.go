@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Usernames holds glob patterns (path.Match syntax, case-insensitive) for
+// the names players log in with, and profile UUIDs. With an allow list only
+// names it matches get in, with allow_uuids only logins carrying one of
+// them; the deny list wins over both. The UUID is the client's word, so
+// allow_uuids is only worth something when the backend authenticates it:
+// in online mode, or, with offline_mode, by requiring the offline UUID of
+// the name as well.
+type Usernames struct {
+	Allow       []string `toml:"allow"`
+	AllowUUIDs  []string `toml:"allow_uuids"`
+	OfflineMode bool     `toml:"offline_mode"`
+	Deny        []string `toml:"deny"`
+	KickMessage string   `toml:"kick_message"`
+
+	uuids map[[16]byte]bool
+}
+
+func (u *Usernames) enabled() bool {
+	return len(u.Allow) > 0 || len(u.AllowUUIDs) > 0 || len(u.Deny) > 0
+}
+
+func (u *Usernames) init() error {
+	for _, list := range [][]string{u.Allow, u.Deny} {
+		for i, p := range list {
+			list[i] = strings.ToLower(p)
+			if _, err := path.Match(list[i], ""); err != nil {
+				return fmt.Errorf("bad pattern %q", p)
+			}
+		}
+	}
+	u.uuids = map[[16]byte]bool{}
+	for _, s := range u.AllowUUIDs {
+		id, err := parseUUID(s)
+		if err != nil {
+			return fmt.Errorf("allow_uuids: %v", err)
+		}
+		u.uuids[id] = true
+	}
+	return nil
+}
+
+// parseUUID accepts a UUID with or without dashes.
+func parseUUID(s string) ([16]byte, error) {
+	var u [16]byte
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		return u, fmt.Errorf("%q is not a UUID", s)
+	}
+	copy(u[:], b)
+	return u, nil
+}
+
+func nameMatch(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether a player may log in with the given Login Start.
+func (u *Usernames) allowed(l loginStart) bool {
+	name := strings.ToLower(l.Name)
+	if nameMatch(u.Deny, name) {
+		return false
+	}
+	if len(u.Allow) > 0 && !nameMatch(u.Allow, name) {
+		return false
+	}
+	if len(u.uuids) > 0 {
+		if !l.HasUUID || !u.uuids[l.UUID] {
+			return false
+		}
+		if u.OfflineMode && l.UUID != offlineUUID(l.Name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestUsernamesAllowed(t *testing.T) {
+	steve := offlineUUID("Steve")
+	other := [16]byte{15: 1}
+	tests := []struct {
+		name  string
+		u     Usernames
+		login loginStart
+		want  bool
+	}{
+		{"no lists", Usernames{}, loginStart{Name: "Steve"}, true},
+		{"deny glob", Usernames{Deny: []string{"bot_*"}}, loginStart{Name: "bot_7"}, false},
+		{"deny is case-insensitive", Usernames{Deny: []string{"BOT_*"}}, loginStart{Name: "Bot_7"}, false},
+		{"deny misses", Usernames{Deny: []string{"bot_*"}}, loginStart{Name: "robot_7"}, true},
+		{"allow glob", Usernames{Allow: []string{"team?_*"}}, loginStart{Name: "Team1_Alex"}, true},
+		{"allow misses", Usernames{Allow: []string{"team?_*"}}, loginStart{Name: "Alex"}, false},
+		{"deny wins over allow", Usernames{Allow: []string{"*"}, Deny: []string{"griefer"}}, loginStart{Name: "Griefer"}, false},
+		{"deny wins over a narrower allow", Usernames{Allow: []string{"admin_*"}, Deny: []string{"*_alt"}}, loginStart{Name: "admin_alt"}, false},
+		{"allow one, deny another", Usernames{Allow: []string{"admin_*"}, Deny: []string{"*_alt"}}, loginStart{Name: "admin_main"}, true},
+		{"character class", Usernames{Deny: []string{"[0-9]*"}}, loginStart{Name: "1337"}, false},
+
+		{"uuid listed", Usernames{AllowUUIDs: []string{"00000000-0000-0000-0000-000000000001"}},
+			loginStart{Name: "Steve", UUID: other, HasUUID: true}, true},
+		{"uuid not listed", Usernames{AllowUUIDs: []string{"00000000000000000000000000000002"}},
+			loginStart{Name: "Steve", UUID: other, HasUUID: true}, false},
+		{"no uuid sent", Usernames{AllowUUIDs: []string{"00000000000000000000000000000001"}},
+			loginStart{Name: "Steve"}, false},
+		{"deny wins over uuid", Usernames{AllowUUIDs: []string{"00000000000000000000000000000001"}, Deny: []string{"steve"}},
+			loginStart{Name: "Steve", UUID: other, HasUUID: true}, false},
+		{"allow and uuid both needed", Usernames{Allow: []string{"alex"}, AllowUUIDs: []string{"00000000000000000000000000000001"}},
+			loginStart{Name: "Steve", UUID: other, HasUUID: true}, false},
+
+		{"offline uuid of the name", Usernames{AllowUUIDs: []string{"5627dd98-e6be-3c21-b8a8-e92344183641"}, OfflineMode: true},
+			loginStart{Name: "Steve", UUID: steve, HasUUID: true}, true},
+		{"offline uuid of another name", Usernames{AllowUUIDs: []string{"5627dd98-e6be-3c21-b8a8-e92344183641"}, OfflineMode: true},
+			loginStart{Name: "Alex", UUID: steve, HasUUID: true}, false},
+		{"listed uuid, not offline", Usernames{AllowUUIDs: []string{"00000000000000000000000000000001"}, OfflineMode: true},
+			loginStart{Name: "Steve", UUID: other, HasUUID: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.u.init(); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.u.allowed(tt.login); got != tt.want {
+				t.Errorf("allowed(%q) = %v, want %v", tt.login.Name, got, tt.want)
+			}
+		})
+	}
+	if err := (&Usernames{Deny: []string{"[a-"}}).init(); err == nil {
+		t.Error("bad pattern accepted")
+	}
+}
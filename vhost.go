@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+type VHost struct {
+	Host    string `toml:"host"`
+	Regex   string `toml:"regex"`
+	FML     string `toml:"fml"`
+	Backend string `toml:"backend"`
+	Pool    string `toml:"pool"`
+
+	re   *regexp.Regexp
+	pool *Pool
+}
+
+type Routing struct {
+	DefaultBackend string `toml:"default_backend"`
+	Unknown        string `toml:"unknown"`
+	KickMessage    string `toml:"kick_message"`
+}
+
+func (v *VHost) init() error {
+	if (v.Backend == "") == (v.Pool == "") || (v.Host != "" && v.Regex != "") || (v.Host == "" && v.Regex == "" && v.FML == "") {
+		return fmt.Errorf("vhost: one of backend or pool and one of host, regex or fml are required")
+	}
+	v.Host = normalizeHost(v.Host)
+	if v.Regex != "" {
+		re, err := regexp.Compile(v.Regex)
+		if err != nil {
+			return fmt.Errorf("vhost %q: %v", v.Regex, err)
+		}
+		v.re = re
+	}
+	return nil
+}
+
+func (v *VHost) match(host, fml string) bool {
+	switch v.FML {
+	case "":
+	case "any":
+		if fml == "" {
+			return false
+		}
+	case "none":
+		if fml != "" {
+			return false
+		}
+	default:
+		if !strings.EqualFold(v.FML, fml) {
+			return false
+		}
+	}
+	switch {
+	case v.re != nil:
+		return v.re.MatchString(host)
+	case v.Host == "":
+		return true
+	}
+	return hostMatch(v.Host, host)
+}
+
+// fmlMarker returns the Forge marker a modded client appends to the server
+// address ("host\0FML2\0" yields "FML2"), or "" for vanilla clients.
+func fmlMarker(h string) string {
+	_, extra, ok := strings.Cut(h, "\x00")
+	if !ok {
+		return ""
+	}
+	m, _, _ := strings.Cut(extra, "\x00")
+	return m
+}
+
+// normalizeHost strips what clients and mods append to the typed address
+// (a trailing dot, \0-separated extras) for matching. IP literals lose their
+// brackets and are written canonically, so "[2001:DB8::1]" matches 2001:db8::1.
+func normalizeHost(h string) string {
+	if i := strings.IndexByte(h, 0); i >= 0 {
+		h = h[:i]
+	}
+	h = strings.ToLower(strings.TrimSuffix(h, "."))
+	if ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(h, "["), "]")); err == nil {
+		return ip.String()
+	}
+	return h
+}
+
+// route picks the backend pool for a connection; ok is false when the hostname
+// matched no vhost and routing.unknown asks to refuse it.
+func (cfg *Config) route(l *Listener, h *clientHello) (p *Pool, ok bool) {
+	if h == nil || h.legacy {
+		return l.pool, true
+	}
+	host, fml := normalizeHost(h.hs.Host), fmlMarker(h.hs.Host)
+	for i := range cfg.VHosts {
+		if cfg.VHosts[i].match(host, fml) {
+			return cfg.VHosts[i].pool, true
+		}
+	}
+	return l.pool, cfg.Routing.Unknown == "default"
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"hash/maphash"
+	"net/netip"
+	"sync"
+)
+
+// udpJob is a client datagram waiting to be written to its backend.
+type udpJob struct {
+	a   *assoc
+	key netip.AddrPort
+	buf *[]byte
+	n   int
+}
+
+// udpWorkers write client datagrams to their backends off the read loop, so
+// that a backend socket that blocks stalls only the datagrams queued behind
+// it. All datagrams of an association go to the same worker and stay in
+// order; when its queue is full they are dropped, as the network would.
+type udpWorkers struct {
+	seed   maphash.Seed
+	queues []chan udpJob
+	bufs   sync.Pool
+}
+
+func newUDPWorkers(n, queue, size int, write func(udpJob)) *udpWorkers {
+	w := &udpWorkers{seed: maphash.MakeSeed(), queues: make([]chan udpJob, n)}
+	w.bufs.New = func() any {
+		b := make([]byte, size)
+		return &b
+	}
+	for i := range w.queues {
+		q := make(chan udpJob, queue)
+		w.queues[i] = q
+		go func() {
+			for j := range q {
+				write(j)
+				w.bufs.Put(j.buf)
+			}
+		}()
+	}
+	return w
+}
+
+// submit queues a copy of p for the association's worker and reports
+// whether there was room.
+func (w *udpWorkers) submit(key netip.AddrPort, a *assoc, p []byte) bool {
+	b := w.bufs.Get().(*[]byte)
+	j := udpJob{a: a, key: key, buf: b, n: copy(*b, p)}
+	select {
+	case w.queues[maphash.Comparable(w.seed, key)%uint64(len(w.queues))] <- j:
+		return true
+	default:
+		w.bufs.Put(b)
+		return false
+	}
+}
+
+// stop lets the workers exit once their queues are empty.
+func (w *udpWorkers) stop() {
+	for _, q := range w.queues {
+		close(q)
+	}
+}